@@ -3,24 +3,50 @@ package rustle
 import (
 	"bytes"
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"math/big"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/ostafen/rustle/core"
 
 	"github.com/ostafen/rustle/client"
+	"github.com/ostafen/rustle/config"
 	"github.com/ostafen/rustle/server"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func setupServer(t *testing.T) func() {
+	return setupServerWithOptions(t, &server.Options{Addr: ":8080"})
+}
+
+func setupServerWithOptions(t *testing.T, opts *server.Options) func() {
 	var err error
-	s := server.NewHTTPServer(":8080")
+	s := server.NewHTTPServer(opts)
 
 	done := make(chan struct{}, 1)
 	go func() {
@@ -147,6 +173,49 @@ func TestStreamSubscription(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestPlainSubscribersStartFromLatest(t *testing.T) {
+	close := setupServer(t)
+	defer close()
+
+	cli := client.New(&client.ClientConfig{
+		Host: endpoint,
+	})
+	require.NoError(t, cli.CreateStream("test"))
+
+	first := client.NewConsumer(&client.ConsumerConfig{Host: endpoint})
+	require.NoError(t, first.Subscribe("test"))
+
+	_, err := cli.Publish("test", "seen")
+	require.NoError(t, err)
+
+	msg, err := first.Listen()
+	require.NoError(t, err)
+	require.Equal(t, "seen", msg.Data)
+
+	// plain subscribers never ack, so delivered messages are not kept pending
+	pending, err := cli.ListPendingQueue("test", "")
+	require.NoError(t, err)
+	require.Empty(t, pending)
+
+	require.NoError(t, first.Close())
+	time.Sleep(time.Millisecond * 100)
+
+	// messages published while nobody is subscribed are not replayed to the next plain subscriber
+	_, err = cli.Publish("test", "missed")
+	require.NoError(t, err)
+
+	second := client.NewConsumer(&client.ConsumerConfig{Host: endpoint})
+	require.NoError(t, second.Subscribe("test"))
+	defer second.Close()
+
+	_, err = cli.Publish("test", "live")
+	require.NoError(t, err)
+
+	msg, err = second.Listen()
+	require.NoError(t, err)
+	require.Equal(t, "live", msg.Data)
+}
+
 func TestStreamSubscriptionWithGroup(t *testing.T) {
 	close := setupServer(t)
 	defer close()
@@ -304,3 +373,2171 @@ func TestPendingQueue(t *testing.T) {
 	require.NoError(t, err)
 	require.Len(t, pending, 90)
 }
+
+func TestPatternSubscription(t *testing.T) {
+	close := setupServer(t)
+	defer close()
+
+	cli := client.New(&client.ClientConfig{
+		Host: endpoint,
+	})
+
+	require.NoError(t, cli.CreateStream("orders.eu"))
+	require.NoError(t, cli.CreateStream("payments"))
+	require.Error(t, cli.CreateStream("orders.*"))
+
+	c := client.NewConsumer(&client.ConsumerConfig{
+		Host: endpoint,
+	})
+	defer c.Close()
+
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+
+		// streams created after the subscription must be attached too
+		require.NoError(t, cli.CreateStream("orders.us"))
+
+		for _, sname := range []string{"orders.eu", "payments", "orders.us"} {
+			resp, err := sendMessage(sname, "ciao")
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+	}()
+
+	require.NoError(t, c.Subscribe("orders.*"))
+
+	streams := make([]string, 0)
+	for i := 0; i < 2; i++ {
+		msg, err := c.Listen()
+		require.NoError(t, err)
+		streams = append(streams, msg.Stream)
+	}
+	require.Equal(t, []string{"orders.eu", "orders.us"}, streams)
+}
+
+func TestMessageFiltering(t *testing.T) {
+	close := setupServer(t)
+	defer close()
+
+	cli := client.New(&client.ClientConfig{
+		Host: endpoint,
+	})
+
+	require.NoError(t, cli.CreateStream("orders"))
+
+	filter := &core.Filter{
+		And: []*core.Filter{
+			{Path: "amount", Op: core.OpGte, Value: float64(10)},
+			{Path: "customer.country", Op: core.OpEq, Value: "IT"},
+		},
+	}
+
+	c := client.NewConsumer(&client.ConsumerConfig{
+		Host:   endpoint,
+		Group:  "test-group",
+		Filter: filter,
+	})
+	defer c.Close()
+
+	const n = 20
+	published := make(chan struct{})
+	go func() {
+		defer func() { published <- struct{}{} }()
+
+		time.Sleep(time.Millisecond * 100)
+		for i := 0; i < n; i++ {
+			country := "IT"
+			if i%2 == 0 {
+				country = "FR"
+			}
+
+			resp, err := sendMessage("orders", map[string]interface{}{
+				"amount":   i,
+				"customer": map[string]interface{}{"country": country},
+			})
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+	}()
+
+	require.NoError(t, c.Subscribe("orders"))
+
+	for i := 0; i < n/4; i++ {
+		msg, err := c.Listen()
+		require.NoError(t, err)
+		require.True(t, filter.Match(msg))
+	}
+	<-published
+
+	pending, err := cli.ListPendingQueue("orders", "test-group")
+	require.NoError(t, err)
+	require.Len(t, pending, n/4)
+
+	msgs, err := cli.ReadStream("orders", "", 0, nil)
+	require.NoError(t, err)
+	require.Len(t, msgs, n)
+
+	msgs, err = cli.ReadStream("orders", "", 0, filter)
+	require.NoError(t, err)
+	require.Len(t, msgs, n/4)
+
+	msgs, err = cli.ReadStream("orders", msgs[0].Id, 2, filter)
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	require.Equal(t, float64(13), msgs[0].Data.(map[string]interface{})["amount"])
+
+	_, err = cli.ReadStream("orders", "", 0, &core.Filter{Path: "amount", Op: "like"})
+	require.Error(t, err)
+}
+
+func TestMessageHeadersAndKey(t *testing.T) {
+	close := setupServer(t)
+	defer close()
+
+	cli := client.New(&client.ClientConfig{
+		Host: endpoint,
+	})
+
+	require.NoError(t, cli.CreateStream("orders"))
+
+	c := client.NewConsumer(&client.ConsumerConfig{
+		Host:   endpoint,
+		Filter: &core.Filter{Path: "$headers.tenant", Op: core.OpEq, Value: "acme"},
+	})
+	defer c.Close()
+
+	published := make(chan string, 1)
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+
+		_, err := cli.PublishMessage(&core.Message{
+			Stream:  "orders",
+			Key:     "order-1",
+			Headers: map[string]string{"tenant": "other"},
+			Data:    "skipped",
+		})
+		require.NoError(t, err)
+
+		id, err := cli.PublishMessage(&core.Message{
+			Stream:  "orders",
+			Key:     "order-2",
+			Headers: map[string]string{"tenant": "acme", "trace-id": "abc"},
+			Data:    "delivered",
+		})
+		require.NoError(t, err)
+		published <- id
+	}()
+
+	require.NoError(t, c.Subscribe("orders"))
+
+	msg, err := c.Listen()
+	require.NoError(t, err)
+	require.Equal(t, <-published, msg.Id)
+	require.Equal(t, "order-2", msg.Key)
+	require.Equal(t, map[string]string{"tenant": "acme", "trace-id": "abc"}, msg.Headers)
+	require.Equal(t, "delivered", msg.Data)
+
+	// metadata can also be supplied through http headers
+	req, err := http.NewRequest(http.MethodPost, endpoint+"/streams/orders", bytes.NewBufferString(`"plain"`))
+	require.NoError(t, err)
+	req.Header.Set("Rustle-Key", "order-3")
+	req.Header.Set("Rustle-Header-Tenant", "acme")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	msgs, err := cli.ReadStream("orders", "", 0, &core.Filter{Path: "$key", Op: core.OpEq, Value: "order-3"})
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	require.Equal(t, map[string]string{"tenant": "acme"}, msgs[0].Headers)
+	require.Equal(t, "plain", msgs[0].Data)
+}
+
+func TestKeyAffinity(t *testing.T) {
+	close := setupServer(t)
+	defer close()
+
+	cli := client.New(&client.ClientConfig{
+		Host: endpoint,
+	})
+
+	require.NoError(t, cli.CreateStream("orders"))
+	require.NoError(t, cli.CreateConsumerGroupWithOptions("test-group", &core.GroupOptions{KeyAffinity: true}))
+
+	info, err := cli.GetConsumerGroupInfo("test-group")
+	require.NoError(t, err)
+	require.True(t, info.Options.KeyAffinity)
+
+	type delivery struct {
+		consumer int
+		msg      *core.Message
+	}
+
+	deliveries := make(chan delivery, 1000)
+	subscribe := func(i int) *client.Consumer {
+		c := client.NewConsumer(&client.ConsumerConfig{
+			Host:  endpoint,
+			Group: "test-group",
+		})
+
+		// the subscription is established before returning, so that Close doesn't race with it
+		require.NoError(t, c.Subscribe("orders"))
+
+		go func() {
+			for msg, err := c.Listen(); err == nil; msg, err = c.Listen() {
+				deliveries <- delivery{consumer: i, msg: msg}
+			}
+		}()
+		return c
+	}
+
+	const nKeys = 10
+	const messagesPerKey = 5
+
+	// publish collects, for each key, the consumer which received its messages,
+	// checking that they all went to the same consumer, in order.
+	publish := func() map[string]int {
+		for seq := 0; seq < messagesPerKey; seq++ {
+			for k := 0; k < nKeys; k++ {
+				_, err := cli.PublishMessage(&core.Message{
+					Stream: "orders",
+					Key:    "order-" + strconv.Itoa(k),
+					Data:   float64(seq),
+				})
+				require.NoError(t, err)
+			}
+		}
+
+		owners := make(map[string]int)
+		lastSeq := make(map[string]float64)
+		for i := 0; i < nKeys*messagesPerKey; i++ {
+			d := <-deliveries
+
+			owner, ok := owners[d.msg.Key]
+			require.True(t, !ok || owner == d.consumer)
+			owners[d.msg.Key] = d.consumer
+
+			last, ok := lastSeq[d.msg.Key]
+			require.True(t, !ok || last < d.msg.Data.(float64))
+			lastSeq[d.msg.Key] = d.msg.Data.(float64)
+		}
+		return owners
+	}
+
+	consumers := make([]*client.Consumer, 0)
+	defer func() {
+		for _, c := range consumers {
+			c.Close()
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		consumers = append(consumers, subscribe(i))
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	owners := publish()
+
+	// keys with in-flight messages must not move when a new consumer joins
+	consumers = append(consumers, subscribe(3))
+	time.Sleep(time.Millisecond * 100)
+
+	require.Equal(t, owners, publish())
+
+	pending, err := cli.ListPendingQueue("orders", "test-group")
+	require.NoError(t, err)
+	require.Len(t, pending, 2*nKeys*messagesPerKey)
+	require.NoError(t, cli.Ack("test-group", map[string][]string{"orders": pending}))
+
+	// once acked, keys are free to be rebalanced
+	newOwners := publish()
+	require.Len(t, newOwners, nKeys)
+}
+
+func TestPartitionedStream(t *testing.T) {
+	close := setupServer(t)
+	defer close()
+
+	cli := client.New(&client.ClientConfig{
+		Host: endpoint,
+	})
+
+	const nPartitions = 4
+	require.NoError(t, cli.CreateStreamWithOptions("events", &core.StreamOptions{Partitions: nPartitions}))
+	require.Error(t, cli.CreateStreamWithOptions("invalid", &core.StreamOptions{Partitions: -1}))
+
+	deliveries := make(chan *core.Message, 1000)
+	owners := make(map[int]int)
+	var mu sync.Mutex
+
+	for i := 0; i < 2; i++ {
+		c := client.NewConsumer(&client.ConsumerConfig{
+			Host:  endpoint,
+			Group: "test-group",
+		})
+		defer c.Close()
+
+		go func(i int) {
+			if err := c.Subscribe("events"); err != nil {
+				return
+			}
+			for msg, err := c.Listen(); err == nil; msg, err = c.Listen() {
+				mu.Lock()
+				owner, ok := owners[msg.Partition]
+				require.True(t, !ok || owner == i)
+				owners[msg.Partition] = i
+				mu.Unlock()
+
+				deliveries <- msg
+			}
+		}(i)
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	const n = 40
+	for i := 0; i < n; i++ {
+		_, err := cli.Publish("events", float64(i))
+		require.NoError(t, err)
+	}
+
+	nextOffset := make(map[int]uint64)
+	for i := 0; i < n; i++ {
+		msg := <-deliveries
+		require.Equal(t, nextOffset[msg.Partition], msg.Offset)
+		nextOffset[msg.Partition]++
+	}
+
+	for p := 0; p < nPartitions; p++ {
+		require.Equal(t, uint64(n/nPartitions), nextOffset[p])
+	}
+
+	mu.Lock()
+	require.Len(t, owners, nPartitions)
+	mu.Unlock()
+
+	msgs, err := cli.ReadPartition("events", 2, 5, 0, nil)
+	require.NoError(t, err)
+	require.Len(t, msgs, n/nPartitions-5)
+	for i, msg := range msgs {
+		require.Equal(t, 2, msg.Partition)
+		require.Equal(t, uint64(5+i), msg.Offset)
+	}
+
+	_, err = cli.ReadPartition("events", nPartitions, 0, 0, nil)
+	require.Error(t, err)
+
+	// messages with the same key are routed to the same partition
+	for i := 0; i < 10; i++ {
+		_, err := cli.PublishMessage(&core.Message{Stream: "events", Key: "order-1", Data: float64(i)})
+		require.NoError(t, err)
+	}
+
+	msgs, err = cli.ReadStream("events", "", 0, &core.Filter{Path: "$key", Op: core.OpEq, Value: "order-1"})
+	require.NoError(t, err)
+	require.Len(t, msgs, 10)
+	for _, msg := range msgs {
+		require.Equal(t, msgs[0].Partition, msg.Partition)
+	}
+
+	streams, err := cli.ListStreams()
+	require.NoError(t, err)
+	require.Len(t, streams, 1)
+	require.Equal(t, "events", streams[0].Name)
+	require.Equal(t, n+10, streams[0].Length)
+	require.Equal(t, nPartitions, streams[0].Partitions)
+	require.Equal(t, uint64(n+10), streams[0].Published)
+}
+
+func TestDelayedDelivery(t *testing.T) {
+	close := setupServer(t)
+	defer close()
+
+	cli := client.New(&client.ClientConfig{
+		Host: endpoint,
+	})
+
+	require.NoError(t, cli.CreateStream("reminders"))
+
+	c := client.NewConsumer(&client.ConsumerConfig{
+		Host: endpoint,
+	})
+	defer c.Close()
+
+	const delay = time.Millisecond * 300
+
+	published := make(chan struct{})
+	go func() {
+		defer func() { published <- struct{}{} }()
+
+		time.Sleep(time.Millisecond * 100)
+
+		_, err := cli.PublishDelayed("reminders", "later", delay)
+		require.NoError(t, err)
+
+		req, err := http.NewRequest(http.MethodPost, endpoint+"/streams/reminders", bytes.NewBufferString(`"even later"`))
+		require.NoError(t, err)
+		req.Header.Set("Rustle-Delay", (delay * 2).String())
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		res := make(map[string]interface{})
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		resp.Body.Close()
+		require.Equal(t, true, res["scheduled"])
+		require.NotContains(t, res, "partition")
+		require.NotContains(t, res, "offset")
+
+		_, err = cli.Publish("reminders", "now")
+		require.NoError(t, err)
+	}()
+
+	require.NoError(t, c.Subscribe("reminders"))
+
+	msg, err := c.Listen()
+	require.NoError(t, err)
+	require.Equal(t, "now", msg.Data)
+	<-published
+
+	streams, err := cli.ListStreams()
+	require.NoError(t, err)
+	require.Len(t, streams, 1)
+	require.Equal(t, 1, streams[0].Length)
+	require.Equal(t, 2, streams[0].Scheduled)
+
+	msgs, err := cli.ReadStream("reminders", "", 0, nil)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+
+	msg, err = c.Listen()
+	require.NoError(t, err)
+	require.Equal(t, "later", msg.Data)
+	require.False(t, time.Now().Before(time.Unix(0, int64(msg.DeliverAt))))
+
+	msg, err = c.Listen()
+	require.NoError(t, err)
+	require.Equal(t, "even later", msg.Data)
+
+	streams, err = cli.ListStreams()
+	require.NoError(t, err)
+	require.Equal(t, 3, streams[0].Length)
+	require.Equal(t, 0, streams[0].Scheduled)
+
+	// delivery instants before 1970 or beyond the range of unix nanoseconds are rejected
+	for _, deliverAt := range []string{"1969-12-31T23:59:59Z", "2300-01-01T00:00:00Z"} {
+		req, err := http.NewRequest(http.MethodPost, endpoint+"/streams/reminders", bytes.NewBufferString(`"never"`))
+		require.NoError(t, err)
+		req.Header.Set("Rustle-Deliver-At", deliverAt)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	}
+
+	resp, err := http.Post(endpoint+"/streams/reminders", "application/vnd.rustle.envelope+json",
+		bytes.NewBufferString(`{"data": "never", "deliverAt": "1900-01-01T00:00:00Z"}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestMessageExpiry(t *testing.T) {
+	close := setupServer(t)
+	defer close()
+
+	cli := client.New(&client.ClientConfig{
+		Host: endpoint,
+	})
+
+	require.NoError(t, cli.CreateStream("presence.expired"))
+	require.NoError(t, cli.CreateStreamWithOptions("presence", &core.StreamOptions{ExpiryStream: "presence.expired"}))
+
+	c := client.NewConsumer(&client.ConsumerConfig{
+		Host:  endpoint,
+		Group: "test-group",
+	})
+	defer c.Close()
+
+	const ttl = time.Millisecond * 200
+
+	published := make(chan string, 1)
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+
+		id, err := cli.PublishWithTTL("presence", "ping", ttl)
+		require.NoError(t, err)
+		published <- id
+	}()
+
+	require.NoError(t, c.Subscribe("presence"))
+
+	msg, err := c.Listen()
+	require.NoError(t, err)
+
+	id := <-published
+	require.Equal(t, id, msg.Id)
+
+	pending, err := cli.ListPendingQueue("presence", "test-group")
+	require.NoError(t, err)
+	require.Equal(t, []string{id}, pending)
+
+	time.Sleep(ttl + time.Millisecond*50)
+
+	pending, err = cli.ListPendingQueue("presence", "test-group")
+	require.NoError(t, err)
+	require.Empty(t, pending)
+
+	msgs, err := cli.ReadStream("presence", "", 0, nil)
+	require.NoError(t, err)
+	require.Empty(t, msgs)
+
+	msgs, err = cli.ReadStream("presence.expired", "", 0, nil)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+
+	notice := msgs[0].Data.(map[string]interface{})
+	require.Equal(t, []interface{}{"test-group"}, notice["groups"])
+	require.Equal(t, id, notice["message"].(map[string]interface{})["Id"])
+
+	// expired messages are not delivered
+	_, err = cli.PublishMessage(&core.Message{Stream: "presence", ExpiresAt: uint64(time.Now().UnixNano()), Data: "expired"})
+	require.NoError(t, err)
+	_, err = cli.Publish("presence", "alive")
+	require.NoError(t, err)
+
+	msg, err = c.Listen()
+	require.NoError(t, err)
+	require.Equal(t, "alive", msg.Data)
+
+	streams, err := cli.ListStreams()
+	require.NoError(t, err)
+	for _, info := range streams {
+		require.Equal(t, 1, info.Length)
+	}
+}
+
+func TestIdempotentPublish(t *testing.T) {
+	close := setupServer(t)
+	defer close()
+
+	cli := client.New(&client.ClientConfig{
+		Host: endpoint,
+	})
+
+	require.NoError(t, cli.CreateStreamWithOptions("payments", &core.StreamOptions{DedupMaxKeys: 2}))
+
+	publish := func(key string) string {
+		id, err := cli.PublishMessage(&core.Message{Stream: "payments", IdempotencyKey: key, Data: key})
+		require.NoError(t, err)
+		return id
+	}
+
+	id := publish("payment-1")
+	require.Equal(t, id, publish("payment-1"))
+
+	// the idempotency key can also be supplied as an http header
+	req, err := http.NewRequest(http.MethodPost, endpoint+"/streams/payments", bytes.NewBufferString(`"payment-1"`))
+	require.NoError(t, err)
+	req.Header.Set("Idempotency-Key", "payment-1")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	res := make(map[string]interface{})
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+	require.Equal(t, id, res["id"])
+	require.Equal(t, true, res["duplicate"])
+
+	msgs, err := cli.ReadStream("payments", "", 0, nil)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+
+	// once more than DedupMaxKeys keys are tracked, the oldest ones are forgotten
+	publish("payment-2")
+	publish("payment-3")
+	require.NotEqual(t, id, publish("payment-1"))
+
+	msgs, err = cli.ReadStream("payments", "", 0, nil)
+	require.NoError(t, err)
+	require.Len(t, msgs, 4)
+
+	_, err = cli.Publish("missing", "data")
+	require.Error(t, err)
+}
+
+func TestPublishTx(t *testing.T) {
+	close := setupServer(t)
+	defer close()
+
+	cli := client.New(&client.ClientConfig{
+		Host: endpoint,
+	})
+
+	require.NoError(t, cli.CreateStream("orders"))
+	require.NoError(t, cli.CreateStream("payments"))
+
+	ids, err := cli.PublishTx([]*core.Message{
+		{Stream: "orders", Key: "order-1", Data: "created"},
+		{Stream: "payments", Key: "order-1", Data: "authorized"},
+	})
+	require.NoError(t, err)
+	require.Len(t, ids, 2)
+
+	for i, sname := range []string{"orders", "payments"} {
+		msgs, err := cli.ReadStream(sname, "", 0, nil)
+		require.NoError(t, err)
+		require.Len(t, msgs, 1)
+		require.Equal(t, ids[i], msgs[0].Id)
+		require.Equal(t, "order-1", msgs[0].Key)
+	}
+
+	// nothing is published if some message targets a missing stream
+	_, err = cli.PublishTx([]*core.Message{
+		{Stream: "orders", Data: "created"},
+		{Stream: "missing", Data: "authorized"},
+	})
+	require.Error(t, err)
+
+	msgs, err := cli.ReadStream("orders", "", 0, nil)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+}
+
+func TestRequestReply(t *testing.T) {
+	close := setupServer(t)
+	defer close()
+
+	cli := client.New(&client.ClientConfig{
+		Host: endpoint,
+	})
+
+	require.NoError(t, cli.CreateStream("rpc"))
+
+	responder := client.NewConsumer(&client.ConsumerConfig{
+		Host:  endpoint,
+		Group: "workers",
+	})
+	defer responder.Close()
+
+	require.NoError(t, responder.Subscribe("rpc"))
+
+	go func() {
+		for msg, err := responder.Listen(); err == nil; msg, err = responder.Listen() {
+			require.NoError(t, cli.Reply(msg, msg.Data.(float64)*2))
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		resp, err := cli.Request(context.Background(), "rpc", float64(i))
+		require.NoError(t, err)
+		require.Equal(t, float64(i*2), resp.Data)
+	}
+
+	// inbox streams are removed once requests complete
+	streams, err := cli.ListStreams()
+	require.NoError(t, err)
+	require.Len(t, streams, 1)
+
+	require.NoError(t, cli.CreateStream("nobody-listens"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	_, err = cli.Request(ctx, "nobody-listens", "hello?")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestEphemeralStream(t *testing.T) {
+	close := setupServer(t)
+	defer close()
+
+	cli := client.New(&client.ClientConfig{
+		Host: endpoint,
+	})
+
+	const idleTimeout = time.Millisecond * 100
+	require.NoError(t, cli.CreateStreamWithOptions("ephemeral", &core.StreamOptions{IdleTimeout: core.Duration(idleTimeout)}))
+
+	c := client.NewConsumer(&client.ConsumerConfig{
+		Host: endpoint,
+	})
+	require.NoError(t, c.Subscribe("ephemeral"))
+
+	// streams having consumers are not deleted
+	time.Sleep(idleTimeout * 2)
+
+	streams, err := cli.ListStreams()
+	require.NoError(t, err)
+	require.Len(t, streams, 1)
+
+	require.NoError(t, c.Close())
+	time.Sleep(idleTimeout * 3)
+
+	streams, err = cli.ListStreams()
+	require.NoError(t, err)
+	require.Empty(t, streams)
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	close := setupServer(t)
+	defer close()
+
+	cli := client.New(&client.ClientConfig{
+		Host: endpoint,
+	})
+
+	require.NoError(t, cli.CreateStream("orders"))
+	require.NoError(t, cli.CreateStream("orders.dlq"))
+
+	var mu sync.Mutex
+	attempts := 0
+	received := make([]*core.Message, 0)
+
+	// the first attempt fails, so that the message is retried
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		msg := &core.Message{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(msg))
+		received = append(received, msg)
+	}))
+	defer hook.Close()
+
+	brokenHook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer brokenHook.Close()
+
+	require.NoError(t, cli.CreateConsumerGroupWithOptions("hook-group", &core.GroupOptions{
+		Webhook: &core.WebhookOptions{
+			URL:            hook.URL,
+			Streams:        []string{"orders"},
+			InitialBackoff: core.Duration(time.Millisecond * 10),
+		},
+	}))
+
+	require.NoError(t, cli.CreateConsumerGroupWithOptions("broken-group", &core.GroupOptions{
+		Webhook: &core.WebhookOptions{
+			URL:              brokenHook.URL,
+			Streams:          []string{"orders"},
+			MaxAttempts:      2,
+			InitialBackoff:   core.Duration(time.Millisecond * 10),
+			DeadLetterStream: "orders.dlq",
+		},
+	}))
+
+	// without a dead letter stream, undelivered messages are kept pending, unless they are explicitly dropped
+	require.NoError(t, cli.CreateConsumerGroupWithOptions("keep-group", &core.GroupOptions{
+		Webhook: &core.WebhookOptions{
+			URL:            brokenHook.URL,
+			Streams:        []string{"orders"},
+			MaxAttempts:    2,
+			InitialBackoff: core.Duration(time.Millisecond * 10),
+		},
+	}))
+
+	require.NoError(t, cli.CreateConsumerGroupWithOptions("drop-group", &core.GroupOptions{
+		Webhook: &core.WebhookOptions{
+			URL:             brokenHook.URL,
+			Streams:         []string{"orders"},
+			MaxAttempts:     2,
+			InitialBackoff:  core.Duration(time.Millisecond * 10),
+			DropUndelivered: true,
+		},
+	}))
+
+	require.Error(t, cli.CreateConsumerGroupWithOptions("invalid-group", &core.GroupOptions{
+		Webhook: &core.WebhookOptions{URL: "not-a-url", Streams: []string{"orders"}},
+	}))
+
+	// the dead letter stream must exist
+	require.Error(t, cli.CreateConsumerGroupWithOptions("invalid-group", &core.GroupOptions{
+		Webhook: &core.WebhookOptions{URL: brokenHook.URL, Streams: []string{"orders"}, DeadLetterStream: "missing.dlq"},
+	}))
+
+	// webhook consumers can't be removed, since they couldn't be restarted
+	req, err := http.NewRequest(http.MethodDelete, endpoint+"/groups/hook-group/consumers/webhook", nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	id, err := cli.Publish("orders", "created")
+	require.NoError(t, err)
+
+	time.Sleep(time.Millisecond * 200)
+
+	mu.Lock()
+	require.Equal(t, 2, attempts)
+	require.Len(t, received, 1)
+	require.Equal(t, id, received[0].Id)
+	mu.Unlock()
+
+	for _, group := range []string{"hook-group", "broken-group", "drop-group"} {
+		pending, err := cli.ListPendingQueue("orders", group)
+		require.NoError(t, err)
+		require.Empty(t, pending)
+	}
+
+	pending, err := cli.ListPendingQueue("orders", "keep-group")
+	require.NoError(t, err)
+	require.Equal(t, []string{id}, pending)
+
+	msgs, err := cli.ReadStream("orders.dlq", "", 0, nil)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	require.Equal(t, "created", msgs[0].Data)
+	require.Equal(t, id, msgs[0].Headers["dead-letter-id"])
+	require.Equal(t, "broken-group", msgs[0].Headers["dead-letter-group"])
+}
+
+func TestDeleteMessages(t *testing.T) {
+	close := setupServer(t)
+	defer close()
+
+	cli := client.New(&client.ClientConfig{
+		Host: endpoint,
+	})
+
+	require.NoError(t, cli.CreateStreamWithOptions("orders", &core.StreamOptions{Partitions: 2}))
+
+	require.NoError(t, cli.CreateConsumerGroup("test-group"))
+
+	c := client.NewConsumer(&client.ConsumerConfig{
+		Host:  endpoint,
+		Group: "test-group",
+	})
+	require.NoError(t, c.Subscribe("orders"))
+	defer c.Close()
+
+	const n = 10
+	ids := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		id, err := cli.Publish("orders", float64(i))
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+
+	for i := 0; i < n; i++ {
+		_, err := c.Listen()
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, cli.DeleteMessage("orders", ids[0]))
+	require.Error(t, cli.DeleteMessage("orders", ids[0]))
+
+	deleted, err := cli.DeleteMessages("orders", []string{ids[1], ids[2], ids[0], "missing"})
+	require.NoError(t, err)
+	require.Equal(t, 2, deleted)
+
+	msgs, err := cli.ReadStream("orders", "", 0, nil)
+	require.NoError(t, err)
+	require.Len(t, msgs, n-3)
+	require.Equal(t, ids[3], msgs[0].Id)
+
+	msgs, err = cli.ReadPartition("orders", 0, 0, 0, nil)
+	require.NoError(t, err)
+	require.Len(t, msgs, 3)
+
+	pending, err := cli.ListPendingQueue("orders", "test-group")
+	require.NoError(t, err)
+	require.Len(t, pending, n-3)
+	require.NotContains(t, pending, ids[0])
+
+	streams, err := cli.ListStreams()
+	require.NoError(t, err)
+	require.Equal(t, n-3, streams[0].Length)
+	require.Equal(t, 3, streams[0].Deleted)
+}
+
+func TestGetMessage(t *testing.T) {
+	close := setupServer(t)
+	defer close()
+
+	cli := client.New(&client.ClientConfig{
+		Host: endpoint,
+	})
+
+	require.NoError(t, cli.CreateStream("orders"))
+
+	const n = 10
+	ids := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		id, err := cli.Publish("orders", float64(i))
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+
+	for i, id := range ids {
+		msg, err := cli.GetMessage("orders", id)
+		require.NoError(t, err)
+		require.Equal(t, id, msg.Id)
+		require.Equal(t, "orders", msg.Stream)
+		require.Equal(t, float64(i), msg.Data)
+	}
+
+	_, err := cli.GetMessage("orders", "missing")
+	require.Error(t, err)
+
+	_, err = cli.GetMessage("missing", ids[0])
+	require.Error(t, err)
+
+	require.NoError(t, cli.DeleteMessage("orders", ids[4]))
+	_, err = cli.GetMessage("orders", ids[4])
+	require.Error(t, err)
+
+	msgs, err := cli.ReadStream("orders", ids[3], 0, nil)
+	require.NoError(t, err)
+	require.Len(t, msgs, n-5)
+	require.Equal(t, ids[5], msgs[0].Id)
+}
+
+func TestConsumerGroupManagement(t *testing.T) {
+	close := setupServer(t)
+	defer close()
+
+	cli := client.New(&client.ClientConfig{
+		Host: endpoint,
+	})
+
+	require.NoError(t, cli.CreateStream("orders"))
+
+	const n = 3
+	ids := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		id, err := cli.Publish("orders", float64(i))
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+
+	require.NoError(t, cli.CreateConsumerGroupWithOptions("from-start", &core.GroupOptions{
+		Streams: map[string]string{"orders": core.StartEarliest},
+	}))
+	require.NoError(t, cli.CreateConsumerGroupWithOptions("from-id", &core.GroupOptions{
+		Streams: map[string]string{"orders": ids[0]},
+	}))
+	require.Error(t, cli.CreateConsumerGroupWithOptions("invalid-id", &core.GroupOptions{
+		Streams: map[string]string{"orders": "missing"},
+	}))
+	require.Error(t, cli.CreateConsumerGroupWithOptions("invalid-stream", &core.GroupOptions{
+		Streams: map[string]string{"missing": core.StartLatest},
+	}))
+
+	c := client.NewConsumer(&client.ConsumerConfig{
+		Host:  endpoint,
+		Group: "from-start",
+		Name:  "c1",
+	})
+	require.NoError(t, c.Subscribe("orders"))
+	defer c.Close()
+
+	for i := 0; i < n; i++ {
+		msg, err := c.Listen()
+		require.NoError(t, err)
+		require.Equal(t, ids[i], msg.Id)
+	}
+
+	info, err := cli.GetConsumerGroupInfo("from-start")
+	require.NoError(t, err)
+	require.Equal(t, "c1", info.Consumers[0].Name)
+	require.Len(t, info.Streams, 1)
+	require.Equal(t, "orders", info.Streams[0].Stream)
+	require.Equal(t, ids[n-1], info.Streams[0].LastDeliveredId)
+	require.Equal(t, n, info.Streams[0].Pending)
+
+	// rewind the group, so that the messages following the first one are delivered again
+	require.NoError(t, cli.SetConsumerGroupId("from-start", "orders", ids[0]))
+	require.Error(t, cli.SetConsumerGroupId("from-start", "orders", "missing"))
+	require.Error(t, cli.SetConsumerGroupId("missing", "orders", ids[0]))
+
+	for i := 1; i < n; i++ {
+		msg, err := c.Listen()
+		require.NoError(t, err)
+		require.Equal(t, ids[i], msg.Id)
+	}
+
+	// groups having connected consumers are only deleted if forced
+	require.Error(t, cli.DeleteConsumerGroup("from-start"))
+
+	require.NoError(t, cli.RemoveConsumer("from-start", "c1"))
+	require.Error(t, cli.RemoveConsumer("from-start", "c1"))
+
+	_, err = c.Listen()
+	require.Error(t, err)
+
+	require.NoError(t, cli.DeleteConsumerGroup("from-start"))
+	require.Error(t, cli.DeleteConsumerGroup("from-start"))
+
+	c2 := client.NewConsumer(&client.ConsumerConfig{
+		Host:  endpoint,
+		Group: "from-id",
+	})
+	require.NoError(t, c2.Subscribe("orders"))
+	defer c2.Close()
+
+	id, err := cli.Publish("orders", float64(n))
+	require.NoError(t, err)
+
+	for _, expected := range append(ids[1:], id) {
+		msg, err := c2.Listen()
+		require.NoError(t, err)
+		require.Equal(t, expected, msg.Id)
+	}
+
+	require.Error(t, cli.DeleteConsumerGroup("from-id"))
+	require.NoError(t, cli.ForceDeleteConsumerGroup("from-id"))
+
+	_, err = c2.Listen()
+	require.Error(t, err)
+}
+
+func TestSlowConsumer(t *testing.T) {
+	close := setupServerWithOptions(t, &server.Options{
+		Addr:   ":8080",
+		Broker: core.BrokerOptions{ConsumerBufferSize: 4},
+	})
+	defer close()
+
+	cli := client.New(&client.ClientConfig{
+		Host: endpoint,
+	})
+
+	require.NoError(t, cli.CreateStream("orders"))
+
+	const n = 50
+	for i := 0; i < n; i++ {
+		_, err := cli.Publish("orders", float64(i))
+		require.NoError(t, err)
+	}
+
+	// the webhook is stuck until the lock is released
+	var stuck sync.Mutex
+	stuck.Lock()
+
+	received := make(chan float64, 2*n)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stuck.Lock()
+		stuck.Unlock()
+
+		msg := &core.Message{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(msg))
+		received <- msg.Data.(float64)
+	}))
+	defer hook.Close()
+
+	// the backlog is larger than the buffer of the consumer, which is stuck on the first message
+	require.NoError(t, cli.CreateConsumerGroupWithOptions("hook-group", &core.GroupOptions{
+		Streams: map[string]string{"orders": core.StartEarliest},
+		Webhook: &core.WebhookOptions{URL: hook.URL, Streams: []string{"orders"}},
+	}))
+
+	// the broker keeps serving requests meanwhile
+	for i := n; i < 2*n; i++ {
+		_, err := cli.Publish("orders", float64(i))
+		require.NoError(t, err)
+	}
+
+	info, err := cli.GetConsumerGroupInfo("hook-group")
+	require.NoError(t, err)
+	require.Greater(t, info.Streams[0].Lag, n)
+
+	stuck.Unlock()
+	for i := 0; i < 2*n; i++ {
+		select {
+		case data := <-received:
+			require.Equal(t, float64(i), data)
+		case <-time.After(time.Second * 5):
+			t.Fatalf("message %d not delivered", i)
+		}
+	}
+}
+
+func TestConsumerGroupMetrics(t *testing.T) {
+	close := setupServer(t)
+	defer close()
+
+	cli := client.New(&client.ClientConfig{
+		Host: endpoint,
+	})
+
+	require.NoError(t, cli.CreateStream("orders"))
+
+	require.NoError(t, cli.CreateConsumerGroupWithOptions("workers", &core.GroupOptions{
+		Streams: map[string]string{"orders": core.StartLatest},
+	}))
+	require.NoError(t, cli.CreateConsumerGroup("empty"))
+
+	const n = 10
+	published := make([]string, 0, n+2)
+	for i := 0; i < n+2; i++ {
+		id, err := cli.Publish("orders", float64(i))
+		require.NoError(t, err)
+		published = append(published, id)
+	}
+
+	// deleted messages no longer count towards the lag
+	deleted, err := cli.DeleteMessages("orders", published[:2])
+	require.NoError(t, err)
+	require.Equal(t, 2, deleted)
+
+	groups, err := cli.ListConsumerGroups()
+	require.NoError(t, err)
+	require.Len(t, groups, 2)
+	require.Equal(t, "empty", groups[0].Name)
+	require.Empty(t, groups[0].Streams)
+
+	// messages are held until a consumer joins
+	info := groups[1].Streams[0]
+	require.Equal(t, "workers", groups[1].Name)
+	require.Equal(t, n, info.Lag)
+	require.Equal(t, 0, info.Pending)
+	require.Zero(t, info.OldestPendingAge)
+
+	resp, err := http.Get(endpoint + "/groups/workers")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	c := client.NewConsumer(&client.ConsumerConfig{
+		Host:  endpoint,
+		Group: "workers",
+	})
+	require.NoError(t, c.Subscribe("orders"))
+	defer c.Close()
+
+	ids := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		msg, err := c.Listen()
+		require.NoError(t, err)
+		ids = append(ids, msg.Id)
+	}
+
+	time.Sleep(time.Millisecond * 10)
+
+	require.NoError(t, cli.Ack("workers", map[string][]string{"orders": ids[:n/2]}))
+
+	group, err := cli.GetConsumerGroupInfo("workers")
+	require.NoError(t, err)
+
+	info = group.Streams[0]
+	require.Equal(t, 0, info.Lag)
+	require.Equal(t, n/2, info.Pending)
+	require.Equal(t, uint64(n), info.Delivered)
+	require.Equal(t, uint64(n/2), info.Acked)
+	require.Greater(t, info.Throughput, 0.0)
+	require.GreaterOrEqual(t, time.Duration(info.OldestPendingAge), time.Millisecond*10)
+}
+
+func TestMetrics(t *testing.T) {
+	close := setupServer(t)
+	defer close()
+
+	cli := client.New(&client.ClientConfig{
+		Host: endpoint,
+	})
+
+	require.NoError(t, cli.CreateStream("orders"))
+
+	c := client.NewConsumer(&client.ConsumerConfig{
+		Host:  endpoint,
+		Group: "workers",
+		Name:  "worker-1",
+	})
+	require.NoError(t, c.Subscribe("orders"))
+	defer c.Close()
+
+	const n = 5
+	ids := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		id, err := cli.Publish("orders", "hello")
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+
+	for i := 0; i < n; i++ {
+		_, err := c.Listen()
+		require.NoError(t, err)
+	}
+	require.NoError(t, cli.Ack("workers", map[string][]string{"orders": ids[:2]}))
+
+	resp, err := http.Get(endpoint + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	body := string(data)
+	for _, line := range []string{
+		`rustle_stream_published_total{stream="orders"} 5`,
+		`rustle_stream_length{stream="orders"} 5`,
+		`rustle_stream_bytes{stream="orders"} 35`,
+		`rustle_group_delivered_total{group="workers",stream="orders"} 5`,
+		`rustle_group_acked_total{group="workers",stream="orders"} 2`,
+		`rustle_group_pending{group="workers",stream="orders"} 3`,
+		`rustle_group_lag{group="workers",stream="orders"} 0`,
+		`rustle_group_consumers{group="workers"} 1`,
+		`rustle_consumer_buffered_messages{consumer="worker-1",group="workers"} 0`,
+		`rustle_http_request_duration_seconds_count{code="200",method="POST",route="/streams/{name}"} 5`,
+	} {
+		require.Contains(t, body, line)
+	}
+}
+
+func TestTracePropagation(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	otel.SetTracerProvider(tp)
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	close := setupServer(t)
+	defer close()
+
+	cli := client.New(&client.ClientConfig{
+		Host: endpoint,
+	})
+
+	require.NoError(t, cli.CreateStream("orders"))
+
+	c := client.NewConsumer(&client.ConsumerConfig{
+		Host:  endpoint,
+		Group: "workers",
+	})
+	require.NoError(t, c.Subscribe("orders"))
+	defer c.Close()
+
+	ctx, producerSpan := tp.Tracer("test").Start(context.Background(), "producer")
+	id, err := cli.PublishMessageContext(ctx, &core.Message{Stream: "orders", Data: "created"})
+	require.NoError(t, err)
+	producerSpan.End()
+
+	msg, err := c.Listen()
+	require.NoError(t, err)
+	require.Equal(t, id, msg.Id)
+	require.Contains(t, msg.Headers, "traceparent")
+
+	traceId := producerSpan.SpanContext().TraceID()
+
+	consumerCtx, consumerSpan := tp.Tracer("test").Start(core.MessageContext(context.Background(), msg), "consumer")
+	require.Equal(t, traceId, consumerSpan.SpanContext().TraceID())
+	require.NoError(t, cli.AckContext(consumerCtx, "workers", map[string][]string{"orders": {id}}))
+	consumerSpan.End()
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID() == traceId {
+			spans[span.Name()] = span
+		}
+	}
+
+	for _, name := range []string{"POST /streams/{name}", "publish orders", "deliver orders", "POST /ack", "ack"} {
+		require.Contains(t, spans, name)
+	}
+
+	require.Equal(t, producerSpan.SpanContext().SpanID(), spans["POST /streams/{name}"].Parent().SpanID())
+	require.Equal(t, spans["POST /streams/{name}"].SpanContext().SpanID(), spans["publish orders"].Parent().SpanID())
+	require.Equal(t, spans["publish orders"].SpanContext().SpanID(), spans["deliver orders"].Parent().SpanID())
+	require.Equal(t, spans["POST /ack"].SpanContext().SpanID(), spans["ack"].Parent().SpanID())
+}
+
+func TestConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rustle.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+listen: ":9090"
+broker:
+  defaultRetention: 24h
+  consumerBufferSize: 64
+  memoryPolicy: evict
+namespaces:
+  default:
+    maxStreams: 100
+  tenant:
+    maxBytes: 1048576
+    maxPublishRate: 50
+limits:
+  streamRate: 1000
+  maxMessageSize: 65536
+logging:
+  level: debug
+metrics:
+  requireAuth: true
+`), 0644))
+
+	env := map[string]string{
+		"RUSTLE_CONFIG":               path,
+		"RUSTLE_CONSUMER_BUFFER_SIZE": "128",
+		"RUSTLE_LOG_LEVEL":            "error",
+		"RUSTLE_SHUTDOWN_TIMEOUT":     "5s",
+		"RUSTLE_MAX_REQUEST_BODY":     "1048576",
+	}
+	getenv := func(name string) string {
+		return env[name]
+	}
+
+	conf, err := config.Load([]string{"-log-level", "info"}, getenv)
+	require.NoError(t, err)
+	require.Equal(t, ":9090", conf.Listen)
+	require.Equal(t, 24*time.Hour, conf.Broker.DefaultRetention)
+	require.Equal(t, 128, conf.Broker.ConsumerBufferSize)
+	require.Equal(t, "evict", conf.Broker.MemoryPolicy)
+	require.Equal(t, "info", conf.Logging.Level)
+	require.Equal(t, 5*time.Second, conf.ShutdownTimeout)
+
+	opts := conf.ServerOptions()
+	require.Equal(t, ":9090", opts.Addr)
+	require.Equal(t, server.LogInfo, opts.LogLevel)
+	require.True(t, opts.MetricsAuth)
+	require.Equal(t, core.BrokerOptions{ConsumerBufferSize: 128, DefaultRetention: 24 * time.Hour, Quotas: core.Quotas{MaxStreams: 100}}, opts.Broker)
+	require.Equal(t, core.Quotas{MaxBytes: 1048576, MaxPublishRate: 50}, opts.Namespaces["tenant"])
+	require.Equal(t, server.RateLimits{StreamRate: 1000, MaxMessageSize: 65536, MaxRequestBody: 1048576}, opts.RateLimits)
+
+	conf, err = config.Load(nil, func(string) string { return "" })
+	require.NoError(t, err)
+	require.Equal(t, config.Default(), conf)
+
+	_, err = config.Load([]string{"-listen", "nope", "-tls-cert", "cert.pem", "-log-level", "verbose"}, getenv)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "listen: invalid address")
+	require.Contains(t, err.Error(), "tls: certFile and keyFile must be set together")
+	require.Contains(t, err.Error(), "logging.level")
+
+	_, err = config.Load([]string{"-consumer-buffer-size", "many"}, getenv)
+	require.Error(t, err)
+
+	_, err = config.Load([]string{"-memory-limit", "1048576", "-memory-policy", "spill"}, getenv)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "broker.memoryPolicy")
+
+	require.NoError(t, os.WriteFile(path, []byte("lisen: \":9090\"\n"), 0644))
+	_, err = config.Load(nil, getenv)
+	require.Error(t, err)
+}
+
+func TestStreamRetention(t *testing.T) {
+	close := setupServer(t)
+	defer close()
+
+	cli := client.New(&client.ClientConfig{
+		Host: endpoint,
+	})
+
+	const retention = time.Millisecond * 200
+
+	require.NoError(t, cli.CreateStreamWithOptions("events", &core.StreamOptions{Retention: core.Duration(retention)}))
+
+	_, err := cli.Publish("events", "short-lived")
+	require.NoError(t, err)
+	_, err = cli.PublishWithTTL("events", "long-lived", time.Minute)
+	require.NoError(t, err)
+
+	// retention doesn't set a TTL on messages
+	msgs, err := cli.ReadStream("events", "", 0, nil)
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	require.Zero(t, msgs[0].ExpiresAt)
+
+	time.Sleep(retention / 2)
+	_, err = cli.Publish("events", "recent")
+	require.NoError(t, err)
+
+	time.Sleep(retention/2 + time.Millisecond*40)
+
+	msgs, err = cli.ReadStream("events", "", 0, nil)
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	require.Equal(t, "long-lived", msgs[0].Data)
+	require.Equal(t, "recent", msgs[1].Data)
+
+	time.Sleep(retention / 2)
+
+	msgs, err = cli.ReadStream("events", "", 0, nil)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	require.Equal(t, "long-lived", msgs[0].Data)
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	s := server.NewHTTPServer(&server.Options{Addr: ":8080"})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.ListenAndServe()
+	}()
+	time.Sleep(time.Millisecond * 10)
+
+	cli := client.New(&client.ClientConfig{
+		Host: endpoint,
+	})
+	require.NoError(t, cli.CreateStream("events"))
+
+	consumer := client.NewConsumer(&client.ConsumerConfig{
+		Host:  endpoint,
+		Group: "group",
+	})
+	require.NoError(t, consumer.Subscribe("events"))
+	defer consumer.Close()
+
+	n := 100
+	for i := 0; i < n; i++ {
+		_, err := cli.Publish("events", i)
+		require.NoError(t, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	require.NoError(t, s.Shutdown(ctx))
+	require.ErrorIs(t, <-done, http.ErrServerClosed)
+
+	// buffered messages are delivered before the shutdown event
+	for i := 0; i < n; i++ {
+		msg, err := consumer.Listen()
+		require.NoError(t, err)
+		require.Equal(t, float64(i), msg.Data)
+	}
+
+	_, err := consumer.Listen()
+	require.ErrorIs(t, err, client.ErrServerShutdown)
+
+	_, err = cli.Publish("events", "late")
+	require.Error(t, err)
+}
+
+func TestAuthentication(t *testing.T) {
+	secret := []byte("secret")
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	close := setupServerWithOptions(t, &server.Options{
+		Addr: ":8080",
+		Authenticators: []server.Authenticator{
+			server.APIKeys{"key": "alice"},
+			&server.JWTVerifier{
+				Keys:     map[string]interface{}{"hmac": secret, "ed": pub},
+				Audience: "rustle",
+			},
+		},
+		MetricsAuth: true,
+	})
+	defer close()
+
+	sign := func(method jwt.SigningMethod, kid string, key interface{}, claims jwt.RegisteredClaims) string {
+		token := jwt.NewWithClaims(method, claims)
+		token.Header["kid"] = kid
+
+		signed, err := token.SignedString(key)
+		require.NoError(t, err)
+		return signed
+	}
+
+	claims := jwt.RegisteredClaims{
+		Subject:   "bob",
+		Audience:  jwt.ClaimStrings{"rustle"},
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	}
+
+	anonymous := client.New(&client.ClientConfig{Host: endpoint})
+	require.Error(t, anonymous.CreateStream("events"))
+
+	wrongKey := client.New(&client.ClientConfig{Host: endpoint, Credentials: client.Credentials{APIKey: "nope"}})
+	require.Error(t, wrongKey.CreateStream("events"))
+
+	cli := client.New(&client.ClientConfig{Host: endpoint, Credentials: client.Credentials{APIKey: "key"}})
+	require.NoError(t, cli.CreateStream("events"))
+
+	// metrics require credentials, since MetricsAuth is set
+	resp, err := http.Get(endpoint + "/metrics")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	req, err := http.NewRequest(http.MethodGet, endpoint+"/metrics", nil)
+	require.NoError(t, err)
+	req.Header.Set(server.APIKeyHeader, "key")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	for _, token := range []string{
+		sign(jwt.SigningMethodHS256, "hmac", secret, claims),
+		sign(jwt.SigningMethodEdDSA, "ed", priv, claims),
+	} {
+		jwtCli := client.New(&client.ClientConfig{Host: endpoint, Credentials: client.Credentials{Token: token}})
+		_, err := jwtCli.Publish("events", "hello")
+		require.NoError(t, err)
+	}
+
+	expired := claims
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+
+	wrongAudience := claims
+	wrongAudience.Audience = jwt.ClaimStrings{"other"}
+
+	for _, token := range []string{
+		sign(jwt.SigningMethodHS256, "hmac", []byte("guess"), claims),
+		sign(jwt.SigningMethodHS256, "ed", []byte(pub), claims), // public key used as HMAC secret
+		sign(jwt.SigningMethodHS256, "hmac", secret, expired),
+		sign(jwt.SigningMethodHS256, "hmac", secret, wrongAudience),
+	} {
+		jwtCli := client.New(&client.ClientConfig{Host: endpoint, Credentials: client.Credentials{Token: token}})
+		_, err := jwtCli.Publish("events", "hello")
+		require.Error(t, err)
+	}
+
+	consumer := client.NewConsumer(&client.ConsumerConfig{
+		Host:        endpoint,
+		Group:       "group",
+		Credentials: client.Credentials{APIKey: "key"},
+	})
+	require.NoError(t, consumer.Subscribe("events"))
+	defer consumer.Close()
+
+	_, err = cli.Publish("events", "world")
+	require.NoError(t, err)
+
+	msg, err := consumer.Listen()
+	require.NoError(t, err)
+	require.Equal(t, "world", msg.Data)
+}
+
+func TestAuthorization(t *testing.T) {
+	acl, err := core.NewACL([]core.Rule{
+		{Principal: "admin", Resource: core.AnyResource, Permissions: []core.Permission{core.PermAdmin}},
+		{Principal: "billing", Resource: "stream:billing.*", Permissions: []core.Permission{core.PermCreate, core.PermPublish, core.PermSubscribe}},
+		{Principal: "billing", Resource: "group:billing", Permissions: []core.Permission{core.PermSubscribe, core.PermAck}},
+	})
+	require.NoError(t, err)
+
+	close := setupServerWithOptions(t, &server.Options{
+		Addr:           ":8080",
+		Authenticators: []server.Authenticator{server.APIKeys{"admin-key": "admin", "billing-key": "billing"}},
+		ACL:            acl,
+	})
+	defer close()
+
+	admin := client.New(&client.ClientConfig{Host: endpoint, Credentials: client.Credentials{APIKey: "admin-key"}})
+	billing := client.New(&client.ClientConfig{Host: endpoint, Credentials: client.Credentials{APIKey: "billing-key"}})
+
+	// metrics can be scraped without credentials
+	resp, err := http.Get(endpoint + "/metrics")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	require.NoError(t, billing.CreateStream("billing.invoices"))
+	require.Error(t, billing.CreateStream("orders"))
+	require.NoError(t, admin.CreateStream("orders"))
+	require.Error(t, billing.DeleteStream("billing.invoices"))
+
+	_, err = billing.Publish("billing.invoices", "invoice")
+	require.NoError(t, err)
+	_, err = billing.Publish("orders", "order")
+	require.Error(t, err)
+	_, err = billing.PublishTx([]*core.Message{
+		core.NewMessage("billing.invoices", "invoice"),
+		core.NewMessage("orders", "order"),
+	})
+	require.Error(t, err)
+
+	// listings only include the streams the principal has some permission on
+	streams, err := billing.ListStreams()
+	require.NoError(t, err)
+	require.Len(t, streams, 1)
+	require.Equal(t, "billing.invoices", streams[0].Name)
+
+	streams, err = admin.ListStreams()
+	require.NoError(t, err)
+	require.Len(t, streams, 2)
+
+	msgs, err := billing.ReadStream("billing.invoices", "", 0, nil)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	_, err = billing.ReadStream("orders", "", 0, nil)
+	require.Error(t, err)
+
+	consumer := client.NewConsumer(&client.ConsumerConfig{
+		Host:        endpoint,
+		Group:       "billing",
+		Credentials: client.Credentials{APIKey: "billing-key"},
+	})
+	require.NoError(t, consumer.Subscribe("billing.invoices"))
+	defer consumer.Close()
+
+	_, err = billing.Publish("billing.invoices", "invoice")
+	require.NoError(t, err)
+
+	msg, err := consumer.Listen()
+	require.NoError(t, err)
+	require.NoError(t, billing.Ack("billing", map[string][]string{"billing.invoices": {msg.Id}}))
+	require.Error(t, billing.Ack("other", map[string][]string{"billing.invoices": {msg.Id}}))
+	require.Error(t, billing.SetConsumerGroupId("billing", "billing.invoices", core.StartEarliest))
+
+	// rules are managed at runtime by admins
+	_, err = billing.ListACLRules()
+	require.Error(t, err)
+
+	rule, err := admin.AddACLRule(core.Rule{Principal: "billing", Resource: "stream:orders", Permissions: []core.Permission{core.PermPublish}})
+	require.NoError(t, err)
+
+	rules, err := admin.ListACLRules()
+	require.NoError(t, err)
+	require.Len(t, rules, 4)
+
+	_, err = billing.Publish("orders", "order")
+	require.NoError(t, err)
+
+	require.NoError(t, admin.RemoveACLRule(rule.Id))
+	_, err = billing.Publish("orders", "order")
+	require.Error(t, err)
+
+	_, err = admin.AddACLRule(core.Rule{Principal: "billing", Resource: "topic:orders", Permissions: []core.Permission{core.PermPublish}})
+	require.Error(t, err)
+
+	// a requested pattern is only authorized by rules covering all the names it matches
+	_, err = admin.AddACLRule(core.Rule{Principal: "billing", Resource: "stream:orders.?", Permissions: []core.Permission{core.PermSubscribe}})
+	require.NoError(t, err)
+
+	for pattern, allowed := range map[string]bool{"orders.*": false, "*": false, "orders.?": true, "billing.*": true, "billing.eu.?": true, "billing.[a-z]": false} {
+		req, err := http.NewRequest(http.MethodGet, endpoint+"/streams/"+url.PathEscape(pattern)+"/messages?cgroup=billing", nil)
+		require.NoError(t, err)
+		req.Header.Set(server.APIKeyHeader, "billing-key")
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		if allowed {
+			require.Equal(t, http.StatusOK, resp.StatusCode, pattern)
+		} else {
+			require.Equal(t, http.StatusForbidden, resp.StatusCode, pattern)
+		}
+	}
+}
+
+// writeCertificate writes to dir the PEM files of a certificate for the given common name, along with its key.
+// The certificate is signed by parent, or it is a self-signed CA if parent is nil.
+func writeCertificate(t *testing.T, dir string, name string, cn string, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{cn},
+	}
+
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	require.NoError(t, err)
+
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+"-key.pem"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600))
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, key
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeCertificate(t, dir, "ca", "rustle-ca", nil, nil)
+	writeCertificate(t, dir, "server", "localhost", ca, caKey)
+	writeCertificate(t, dir, "client", "billing", ca, caKey)
+
+	acl, err := core.NewACL([]core.Rule{
+		{Principal: "billing", Resource: "stream:billing.*", Permissions: []core.Permission{core.PermCreate, core.PermPublish, core.PermSubscribe}},
+		{Principal: "billing", Resource: "group:*", Permissions: []core.Permission{core.PermSubscribe}},
+	})
+	require.NoError(t, err)
+
+	close := setupServerWithOptions(t, &server.Options{
+		Addr: ":8080",
+		TLS: &server.TLSOptions{
+			CertFile:     filepath.Join(dir, "server.pem"),
+			KeyFile:      filepath.Join(dir, "server-key.pem"),
+			ClientCAFile: filepath.Join(dir, "ca.pem"),
+		},
+		Authenticators: []server.Authenticator{server.ClientCertificates{}},
+		ACL:            acl,
+	})
+	defer close()
+
+	const httpsEndpoint = "https://localhost:8080"
+
+	tlsConf := &client.TLSConfig{
+		CAFile:   filepath.Join(dir, "ca.pem"),
+		CertFile: filepath.Join(dir, "client.pem"),
+		KeyFile:  filepath.Join(dir, "client-key.pem"),
+	}
+
+	// the principal is the subject of the client certificate
+	cli := client.New(&client.ClientConfig{Host: httpsEndpoint, TLS: tlsConf})
+	require.NoError(t, cli.CreateStream("billing.events"))
+	require.Error(t, cli.CreateStream("orders"))
+
+	noCert := client.New(&client.ClientConfig{Host: httpsEndpoint, TLS: &client.TLSConfig{CAFile: tlsConf.CAFile}})
+	require.Error(t, noCert.CreateStream("billing.other"))
+
+	untrusted := client.New(&client.ClientConfig{Host: httpsEndpoint})
+	require.Error(t, untrusted.CreateStream("billing.other"))
+
+	byAddress := client.New(&client.ClientConfig{Host: "https://127.0.0.1:8080", TLS: tlsConf})
+	require.Error(t, byAddress.CreateStream("billing.other"))
+
+	serverName := *tlsConf
+	serverName.ServerName = "localhost"
+	byAddress = client.New(&client.ClientConfig{Host: "https://127.0.0.1:8080", TLS: &serverName})
+	require.NoError(t, byAddress.CreateStream("billing.other"))
+
+	consumer := client.NewConsumer(&client.ConsumerConfig{Host: httpsEndpoint, Group: "billing", TLS: tlsConf})
+	require.NoError(t, consumer.Subscribe("billing.events"))
+	defer consumer.Close()
+
+	_, err = cli.Publish("billing.events", "invoice")
+	require.NoError(t, err)
+
+	msg, err := consumer.Listen()
+	require.NoError(t, err)
+	require.Equal(t, "invoice", msg.Data)
+
+	// certificates replaced on disk are served to new connections
+	renewed, _ := writeCertificate(t, dir, "server", "localhost", ca, caKey)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	conn, err := tls.Dial("tcp", "localhost:8080", &tls.Config{RootCAs: roots})
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, renewed.SerialNumber, conn.ConnectionState().PeerCertificates[0].SerialNumber)
+}
+
+func TestNamespaces(t *testing.T) {
+	close := setupServerWithOptions(t, &server.Options{
+		Addr: ":8080",
+		Namespaces: map[string]core.Quotas{
+			"limited": {MaxStreams: 1, MaxPublishRate: 1},
+		},
+	})
+	defer close()
+
+	admin := client.New(&client.ClientConfig{Host: endpoint})
+	require.NoError(t, admin.CreateNamespace("tenant", core.Quotas{MaxBytes: 1024}))
+	require.Error(t, admin.CreateNamespace("tenant", core.Quotas{}))
+	require.Error(t, admin.CreateNamespace("invalid/name", core.Quotas{}))
+
+	infos, err := admin.ListNamespaces()
+	require.NoError(t, err)
+	require.Len(t, infos, 3)
+	require.Equal(t, "default", infos[0].Name)
+	require.Equal(t, "limited", infos[1].Name)
+	require.Equal(t, "tenant", infos[2].Name)
+
+	// streams having the same name in different namespaces are isolated
+	def := client.New(&client.ClientConfig{Host: endpoint})
+	tenant := client.New(&client.ClientConfig{Host: endpoint, Namespace: "tenant"})
+
+	require.NoError(t, def.CreateStream("orders"))
+	require.NoError(t, tenant.CreateStream("orders"))
+
+	_, err = tenant.Publish("orders", "order")
+	require.NoError(t, err)
+
+	msgs, err := def.ReadStream("orders", "", 0, nil)
+	require.NoError(t, err)
+	require.Len(t, msgs, 0)
+
+	msgs, err = tenant.ReadStream("orders", "", 0, nil)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+
+	consumer := client.NewConsumer(&client.ConsumerConfig{Host: endpoint, Namespace: "tenant", Group: "billing"})
+	require.NoError(t, consumer.Subscribe("orders"))
+	defer consumer.Close()
+
+	id, err := tenant.Publish("orders", "order")
+	require.NoError(t, err)
+
+	msg, err := consumer.Listen()
+	require.NoError(t, err)
+	require.Equal(t, id, msg.Id)
+
+	_, err = def.GetConsumerGroupInfo("billing")
+	require.Error(t, err)
+
+	// the memory quota rejects messages which don't fit
+	resp, err := http.Post(endpoint+"/ns/tenant/streams/orders", "application/json", strings.NewReader(`"`+strings.Repeat("x", 2048)+`"`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusInsufficientStorage, resp.StatusCode)
+	require.Empty(t, resp.Header.Get("Retry-After"))
+
+	info, err := admin.GetNamespaceInfo("tenant")
+	require.NoError(t, err)
+	require.Equal(t, 1024, info.Quotas.MaxBytes)
+	require.Equal(t, 1, info.Stats.Streams)
+	require.Equal(t, 1, info.Stats.Groups)
+	require.Equal(t, 1, info.Stats.Consumers)
+	require.Equal(t, 2, info.Stats.Messages)
+
+	// quotas of the namespaces created at startup
+	limited := client.New(&client.ClientConfig{Host: endpoint, Namespace: "limited"})
+	require.NoError(t, limited.CreateStream("orders"))
+
+	req, err := http.NewRequest(http.MethodPut, endpoint+"/ns/limited/streams/payments", nil)
+	require.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	_, err = limited.Publish("orders", "order")
+	require.NoError(t, err)
+
+	resp, err = http.Post(endpoint+"/ns/limited/streams/orders", "application/json", strings.NewReader(`"order"`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, "1", resp.Header.Get("Retry-After"))
+
+	_, err = admin.GetNamespaceInfo("unknown")
+	require.Error(t, err)
+	_, err = client.New(&client.ClientConfig{Host: endpoint, Namespace: "unknown"}).ListStreams()
+	require.Error(t, err)
+
+	require.Error(t, admin.DeleteNamespace("default"))
+	require.NoError(t, admin.DeleteNamespace("tenant"))
+	_, err = tenant.ListStreams()
+	require.Error(t, err)
+}
+
+func TestRateLimiting(t *testing.T) {
+	close := setupServerWithOptions(t, &server.Options{
+		Addr: ":8080",
+		RateLimits: server.RateLimits{
+			StreamRate:     2,
+			PrincipalRate:  100,
+			MaxMessageSize: 64,
+			MaxRequestBody: 256,
+		},
+		Broker: core.BrokerOptions{Quotas: core.Quotas{MaxBytes: 150}},
+	})
+	defer close()
+
+	cli := client.New(&client.ClientConfig{Host: endpoint})
+	require.NoError(t, cli.CreateStream("orders"))
+	require.NoError(t, cli.CreateStream("payments"))
+
+	for i := 0; i < 2; i++ {
+		_, err := cli.Publish("orders", "order")
+		require.NoError(t, err)
+	}
+
+	resp, err := http.Post(endpoint+"/streams/orders", "application/json", strings.NewReader(`"order"`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, "1", resp.Header.Get("Retry-After"))
+
+	// limits of other streams are not affected
+	_, err = cli.Publish("payments", "payment")
+	require.NoError(t, err)
+
+	// publishes to missing streams are rejected before being rate limited
+	for i := 0; i < 3; i++ {
+		resp, err := http.Post(endpoint+"/streams/missing", "application/json", strings.NewReader(`"order"`))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	}
+
+	// transactions are rejected as a whole, without consuming tokens
+	_, err = cli.PublishTx([]*core.Message{
+		core.NewMessage("payments", "payment"),
+		core.NewMessage("orders", "order"),
+	})
+	require.Error(t, err)
+	_, err = cli.Publish("payments", "payment")
+	require.NoError(t, err)
+
+	_, err = cli.Publish("payments", strings.Repeat("x", 128))
+	require.Error(t, err)
+
+	resp, err = http.Post(endpoint+"/tx", "application/json", strings.NewReader(strings.Repeat(" ", 512)))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	// throttled publishes are retried, honoring Retry-After
+	retrying := client.New(&client.ClientConfig{
+		Host:  endpoint,
+		Retry: &client.RetryPolicy{MaxRetries: 3, Backoff: 10 * time.Millisecond},
+	})
+
+	start := time.Now()
+	_, err = retrying.Publish("orders", "order")
+	require.NoError(t, err)
+	require.Less(t, time.Since(start), 3*time.Second)
+
+	// publishes rejected by the broker don't consume tokens
+	require.NoError(t, cli.CreateStream("audit"))
+	_, err = cli.Publish("audit", strings.Repeat("x", 58))
+	require.NoError(t, err)
+
+	resp, err = http.Post(endpoint+"/streams/audit", "application/json", strings.NewReader(`"`+strings.Repeat("x", 58)+`"`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusInsufficientStorage, resp.StatusCode)
+
+	_, err = cli.Publish("audit", "entry")
+	require.NoError(t, err)
+
+	resp, err = http.Get(endpoint + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	body := string(data)
+	for _, line := range []string{
+		`rustle_throttled_requests_total{limit="message_size"} 1`,
+		`rustle_throttled_requests_total{limit="request_body"} 1`,
+	} {
+		require.Contains(t, body, line)
+	}
+	require.Regexp(t, `rustle_throttled_requests_total\{limit="stream"\} [2-9]`, body)
+}
+
+func TestMemoryBudget(t *testing.T) {
+	payload := strings.Repeat("x", 30)
+	size := int64(core.NewMessage("orders", payload).Size())
+
+	t.Run("reject", func(t *testing.T) {
+		close := setupServerWithOptions(t, &server.Options{
+			Addr:   ":8080",
+			Broker: core.BrokerOptions{Memory: core.NewMemoryBudget(3*size, core.MemoryReject)},
+		})
+		defer close()
+
+		cli := client.New(&client.ClientConfig{Host: endpoint})
+		require.NoError(t, cli.CreateNamespace("tenant", core.Quotas{}))
+		tenant := client.New(&client.ClientConfig{Host: endpoint, Namespace: "tenant"})
+
+		require.NoError(t, cli.CreateStream("orders"))
+		require.NoError(t, tenant.CreateStream("orders"))
+
+		for i := 0; i < 2; i++ {
+			_, err := cli.Publish("orders", payload)
+			require.NoError(t, err)
+		}
+
+		// the budget is shared by all the namespaces
+		_, err := tenant.Publish("orders", payload)
+		require.NoError(t, err)
+
+		resp, err := http.Post(endpoint+"/ns/tenant/streams/orders", "application/json", strings.NewReader(`"`+payload+`"`))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusInsufficientStorage, resp.StatusCode)
+
+		info, err := cli.GetNamespaceInfo("tenant")
+		require.NoError(t, err)
+		require.NotNil(t, info.Stats.Memory)
+		require.Equal(t, core.MemoryUsage{Limit: 3 * size, Used: 3 * size, Policy: core.MemoryReject, Rejected: 1}, *info.Stats.Memory)
+
+		// deleting messages releases memory
+		require.NoError(t, cli.DeleteStream("orders"))
+		_, err = tenant.Publish("orders", payload)
+		require.NoError(t, err)
+	})
+
+	t.Run("evict", func(t *testing.T) {
+		close := setupServerWithOptions(t, &server.Options{
+			Addr:   ":8080",
+			Broker: core.BrokerOptions{Memory: core.NewMemoryBudget(3*size, core.MemoryEvict)},
+		})
+		defer close()
+
+		cli := client.New(&client.ClientConfig{Host: endpoint})
+		require.NoError(t, cli.CreateStream("orders"))
+		require.NoError(t, cli.CreateStream("payments"))
+
+		consumer := client.NewConsumer(&client.ConsumerConfig{Host: endpoint, Group: "workers"})
+		require.NoError(t, consumer.Subscribe("orders"))
+		defer consumer.Close()
+
+		ids := make([]string, 0)
+		for i := 0; i < 3; i++ {
+			id, err := cli.Publish("orders", payload)
+			require.NoError(t, err)
+			ids = append(ids, id)
+
+			_, err = consumer.Listen()
+			require.NoError(t, err)
+		}
+
+		// pending messages are kept, so publishes are rejected when no message can be evicted
+		resp, err := http.Post(endpoint+"/streams/payments", "application/json", strings.NewReader(`"`+payload+`"`))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusInsufficientStorage, resp.StatusCode)
+
+		// once acked, the oldest message is evicted to make room
+		require.NoError(t, cli.Ack("workers", map[string][]string{"orders": ids[:1]}))
+		_, err = cli.Publish("payments", payload)
+		require.NoError(t, err)
+
+		msgs, err := cli.ReadStream("orders", "", 0, nil)
+		require.NoError(t, err)
+		require.Len(t, msgs, 2)
+		require.Equal(t, ids[1], msgs[0].Id)
+
+		// messages of streams without groups are evicted as well, while pending ones are still kept
+		id, err := cli.Publish("payments", payload)
+		require.NoError(t, err)
+
+		msgs, err = cli.ReadStream("payments", "", 0, nil)
+		require.NoError(t, err)
+		require.Len(t, msgs, 1)
+		require.Equal(t, id, msgs[0].Id)
+
+		msgs, err = cli.ReadStream("orders", "", 0, nil)
+		require.NoError(t, err)
+		require.Len(t, msgs, 2)
+
+		// messages larger than the whole budget are rejected without evicting anything
+		_, err = cli.Publish("payments", strings.Repeat(payload, 4))
+		require.Error(t, err)
+
+		resp, err = http.Get(endpoint + "/metrics")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Contains(t, string(data), "rustle_memory_evicted_messages_total 2")
+		require.Contains(t, string(data), "rustle_memory_rejected_total 2")
+	})
+
+	t.Run("evict with plain subscribers", func(t *testing.T) {
+		close := setupServerWithOptions(t, &server.Options{
+			Addr:   ":8080",
+			Broker: core.BrokerOptions{Memory: core.NewMemoryBudget(3*size, core.MemoryEvict)},
+		})
+		defer close()
+
+		cli := client.New(&client.ClientConfig{Host: endpoint})
+		require.NoError(t, cli.CreateStream("events"))
+
+		// plain subscribers never ack, so they don't prevent eviction
+		consumer := client.NewConsumer(&client.ConsumerConfig{Host: endpoint})
+		require.NoError(t, consumer.Subscribe("events"))
+		defer consumer.Close()
+
+		const n = 10
+		for i := 0; i < n; i++ {
+			id, err := cli.Publish("events", payload)
+			require.NoError(t, err)
+
+			msg, err := consumer.Listen()
+			require.NoError(t, err)
+			require.Equal(t, id, msg.Id)
+		}
+
+		msgs, err := cli.ReadStream("events", "", 0, nil)
+		require.NoError(t, err)
+
+		info, err := cli.GetNamespaceInfo(server.DefaultNamespace)
+		require.NoError(t, err)
+		require.Equal(t, uint64(n-len(msgs)), info.Stats.Memory.Evicted)
+		require.Zero(t, info.Stats.Memory.Rejected)
+	})
+
+	t.Run("evict across namespaces", func(t *testing.T) {
+		close := setupServerWithOptions(t, &server.Options{
+			Addr:   ":8080",
+			Broker: core.BrokerOptions{Memory: core.NewMemoryBudget(3*size, core.MemoryEvict)},
+		})
+		defer close()
+
+		cli := client.New(&client.ClientConfig{Host: endpoint})
+		require.NoError(t, cli.CreateNamespace("tenant", core.Quotas{MaxPublishRate: 1}))
+		tenant := client.New(&client.ClientConfig{Host: endpoint, Namespace: "tenant"})
+
+		require.NoError(t, cli.CreateStream("orders"))
+		require.NoError(t, tenant.CreateStream("payments"))
+
+		consumer := client.NewConsumer(&client.ConsumerConfig{Host: endpoint, Group: "workers"})
+		require.NoError(t, consumer.Subscribe("orders"))
+		defer consumer.Close()
+
+		ids := make([]string, 0)
+		for i := 0; i < 2; i++ {
+			id, err := cli.Publish("orders", payload)
+			require.NoError(t, err)
+			ids = append(ids, id)
+
+			_, err = consumer.Listen()
+			require.NoError(t, err)
+		}
+		require.NoError(t, cli.Ack("workers", map[string][]string{"orders": ids}))
+
+		_, err := tenant.Publish("payments", payload)
+		require.NoError(t, err)
+
+		// publishes exceeding the publish rate are rejected before any message is evicted
+		resp, err := http.Post(endpoint+"/ns/tenant/streams/payments", "application/json", strings.NewReader(`"`+payload+`"`))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+		msgs, err := cli.ReadStream("orders", "", 0, nil)
+		require.NoError(t, err)
+		require.Len(t, msgs, 2)
+
+		// acked messages of the default namespace are evicted to make room for the tenant
+		time.Sleep(time.Second)
+		_, err = tenant.Publish("payments", payload)
+		require.NoError(t, err)
+
+		msgs, err = cli.ReadStream("orders", "", 0, nil)
+		require.NoError(t, err)
+		require.Len(t, msgs, 0)
+
+		info, err := tenant.GetNamespaceInfo("tenant")
+		require.NoError(t, err)
+		require.Equal(t, core.MemoryUsage{Limit: 3 * size, Used: 2 * size, Policy: core.MemoryEvict, Evicted: 2}, *info.Stats.Memory)
+	})
+}
@@ -4,36 +4,221 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/ostafen/rustle/core"
+	uuid "github.com/satori/go.uuid"
+	"go.opentelemetry.io/otel/propagation"
 )
 
+// Credentials authenticate requests to the server. At most one of them should be set.
+type Credentials struct {
+	// APIKey is sent through the X-API-Key header
+	APIKey string
+	// Token is a JWT, sent as a bearer token
+	Token string
+}
+
+func (cred *Credentials) apply(req *http.Request) {
+	if cred.APIKey != "" {
+		req.Header.Set("X-API-Key", cred.APIKey)
+	}
+	if cred.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+cred.Token)
+	}
+}
+
+// TLSConfig configures the connections to a server serving https.
+type TLSConfig struct {
+	// CAFile is the path of a PEM bundle of the CAs used to verify the server (the system ones, if not set)
+	CAFile string
+	// CertFile and KeyFile, if set, are the paths of the certificate presented to the server and of its private key
+	CertFile string
+	KeyFile  string
+	// ServerName, if set, overrides the host name used to verify the server certificate
+	ServerName string
+}
+
+func newHTTPClient(conf *TLSConfig) (*http.Client, error) {
+	if conf == nil {
+		return http.DefaultClient, nil
+	}
+
+	tlsConf := &tls.Config{ServerName: conf.ServerName}
+
+	if conf.CAFile != "" {
+		data, err := os.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConf.RootCAs = x509.NewCertPool()
+		if !tlsConf.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found inside %s", conf.CAFile)
+		}
+	}
+
+	if conf.CertFile != "" || conf.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConf
+	return &http.Client{Transport: transport}, nil
+}
+
+// namespaceURL returns the url under which the streams and groups of a namespace are served.
+func namespaceURL(host string, namespace string) string {
+	if namespace == "" {
+		return host
+	}
+	return fmt.Sprintf("%s/ns/%s", host, url.PathEscape(namespace))
+}
+
+// RetryPolicy makes the requests throttled by the server (429 Too Many Requests) be retried.
+type RetryPolicy struct {
+	// MaxRetries is the maximum number of times a request is retried
+	MaxRetries int
+	// Backoff is the delay before the first retry, which doubles on each further retry, up to MaxBackoff.
+	// Longer delays requested by the server through the Retry-After header take precedence.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// delay returns the time to wait before retrying a request for the n-th time (starting from zero).
+func (p *RetryPolicy) delay(n int, resp *http.Response) time.Duration {
+	d := p.Backoff
+	for i := 0; i < n && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && time.Duration(secs)*time.Second > d {
+		d = time.Duration(secs) * time.Second
+	}
+	return d
+}
+
 type ClientConfig struct {
 	Host string
+	// Namespace, if set, is the namespace of the streams and groups accessed by the client.
+	// Otherwise, the default namespace is used.
+	Namespace   string
+	Credentials Credentials
+	// TLS, if set, configures the connections to a server serving https
+	TLS *TLSConfig
+	// Retry, if set, makes throttled requests be retried
+	Retry *RetryPolicy
 }
 
 type Client struct {
 	conf *ClientConfig
+	http *http.Client
+	// err is the error occurred while loading the TLS configuration, if any, and it is returned by every request
+	err error
 }
 
 func New(conf *ClientConfig) *Client {
+	httpClient, err := newHTTPClient(conf.TLS)
 	return &Client{
 		conf: conf,
+		http: httpClient,
+		err:  err,
+	}
+}
+
+func (c *Client) baseURL() string {
+	return namespaceURL(c.conf.Host, c.conf.Namespace)
+}
+
+// do sends a request to the server, authenticating it with the configured credentials.
+// Throttled requests are retried according to the retry policy, if any.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	c.conf.Credentials.apply(req)
+	for n := 0; ; n++ {
+		resp, err := c.http.Do(req)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests || c.conf.Retry == nil || n >= c.conf.Retry.MaxRetries {
+			return resp, err
+		}
+
+		// the body of the request must be sent again
+		if req.Body != nil && req.GetBody == nil {
+			return resp, err
+		}
+
+		delay := c.conf.Retry.delay(n, resp)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func (c *Client) get(uri string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
 	}
+	return c.do(req)
+}
+
+func (c *Client) post(uri string, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, uri, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return c.do(req)
 }
 
 func (c *Client) CreateConsumerGroup(cgroup string) error {
-	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/groups/%s", c.conf.Host, cgroup), nil)
+	return c.CreateConsumerGroupWithOptions(cgroup, &core.GroupOptions{})
+}
+
+func (c *Client) CreateConsumerGroupWithOptions(cgroup string, opts *core.GroupOptions) error {
+	data, err := json.Marshal(opts)
 	if err != nil {
 		return err
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/groups/%s", c.baseURL(), cgroup), bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req)
 	if err != nil {
 		return err
 	}
@@ -44,13 +229,28 @@ func (c *Client) CreateConsumerGroup(cgroup string) error {
 	return err
 }
 
+// DeleteConsumerGroup deletes a consumer group. It fails if the group has connected consumers.
 func (c *Client) DeleteConsumerGroup(cgroup string) error {
-	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/groups/%s", c.conf.Host, cgroup), nil)
+	return c.deleteConsumerGroup(cgroup, false)
+}
+
+// ForceDeleteConsumerGroup deletes a consumer group, disconnecting all of its consumers.
+func (c *Client) ForceDeleteConsumerGroup(cgroup string) error {
+	return c.deleteConsumerGroup(cgroup, true)
+}
+
+func (c *Client) deleteConsumerGroup(cgroup string, force bool) error {
+	uri := fmt.Sprintf("%s/groups/%s", c.baseURL(), cgroup)
+	if force {
+		uri += "?force=true"
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, uri, nil)
 	if err != nil {
 		return err
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return err
 	}
@@ -61,13 +261,61 @@ func (c *Client) DeleteConsumerGroup(cgroup string) error {
 	return err
 }
 
+// SetConsumerGroupId moves the cursor of a group on a stream right after the message with the given id.
+// The id can also be core.StartEarliest or core.StartLatest.
+func (c *Client) SetConsumerGroupId(cgroup string, sname string, id string) error {
+	data, err := json.Marshal(map[string]string{"id": id})
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.post(fmt.Sprintf("%s/groups/%s/streams/%s/setid", c.baseURL(), cgroup, sname), "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to set id of consumer group \"%s\" on stream %s", cgroup, sname)
+	}
+	return nil
+}
+
+// RemoveConsumer disconnects the consumer with the given name from a group.
+func (c *Client) RemoveConsumer(cgroup string, name string) error {
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/groups/%s/consumers/%s", c.baseURL(), cgroup, name), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to remove consumer %s from group \"%s\"", name, cgroup)
+	}
+	return nil
+}
+
 func (c *Client) CreateStream(sname string) error {
-	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/streams/%s", c.conf.Host, sname), nil)
+	return c.CreateStreamWithOptions(sname, &core.StreamOptions{})
+}
+
+func (c *Client) CreateStreamWithOptions(sname string, opts *core.StreamOptions) error {
+	data, err := json.Marshal(opts)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/streams/%s", c.baseURL(), sname), bytes.NewBuffer(data))
 	if err != nil {
 		return err
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return err
 	}
@@ -79,12 +327,12 @@ func (c *Client) CreateStream(sname string) error {
 }
 
 func (c *Client) DeleteStream(sname string) error {
-	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/streams/%s", c.conf.Host, sname), nil)
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/streams/%s", c.baseURL(), sname), nil)
 	if err != nil {
 		return err
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return err
 	}
@@ -95,8 +343,74 @@ func (c *Client) DeleteStream(sname string) error {
 	return err
 }
 
+// GetMessage fetches the message of a stream having the given id.
+func (c *Client) GetMessage(sname string, id string) (*core.Message, error) {
+	resp, err := c.get(fmt.Sprintf("%s/streams/%s/messages/%s", c.baseURL(), sname, id))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("no message with id %s in stream %s", id, sname)
+	}
+
+	msg := &core.Message{}
+	err = json.NewDecoder(resp.Body).Decode(msg)
+	return msg, err
+}
+
+// DeleteMessage removes a single message from a stream.
+func (c *Client) DeleteMessage(sname string, id string) error {
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/streams/%s/messages/%s", c.baseURL(), sname, id), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to delete message %s from stream %s", id, sname)
+	}
+	return nil
+}
+
+// DeleteMessages removes the messages with the given ids from a stream, and returns the number
+// of messages which have actually been deleted.
+func (c *Client) DeleteMessages(sname string, ids []string) (int, error) {
+	data, err := json.Marshal(ids)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/streams/%s/messages", c.baseURL(), sname), bytes.NewBuffer(data))
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unable to delete messages from stream %s", sname)
+	}
+
+	res := struct {
+		Deleted int `json:"deleted"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	return res.Deleted, err
+}
+
 func (c *Client) ListStreams() ([]core.StreamInfo, error) {
-	resp, err := http.Get(fmt.Sprintf("%s/streams", c.conf.Host))
+	resp, err := c.get(fmt.Sprintf("%s/streams", c.baseURL()))
 	if err != nil {
 		return nil, err
 	}
@@ -106,8 +420,264 @@ func (c *Client) ListStreams() ([]core.StreamInfo, error) {
 	return sInfos, err
 }
 
+const envelopeContentType = "application/vnd.rustle.envelope+json"
+
+type envelope struct {
+	Key            string            `json:"key,omitempty"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	IdempotencyKey string            `json:"idempotencyKey,omitempty"`
+	ReplyTo        string            `json:"replyTo,omitempty"`
+	CorrelationId  string            `json:"correlationId,omitempty"`
+	DeliverAt      *time.Time        `json:"deliverAt,omitempty"`
+	ExpiresAt      *time.Time        `json:"expiresAt,omitempty"`
+	Data           interface{}       `json:"data"`
+}
+
+func newEnvelope(msg *core.Message) *envelope {
+	env := &envelope{
+		Key:            msg.Key,
+		Headers:        msg.Headers,
+		IdempotencyKey: msg.IdempotencyKey,
+		ReplyTo:        msg.ReplyTo,
+		CorrelationId:  msg.CorrelationId,
+		Data:           msg.Data,
+	}
+	if msg.DeliverAt != 0 {
+		deliverAt := time.Unix(0, int64(msg.DeliverAt))
+		env.DeliverAt = &deliverAt
+	}
+	if msg.ExpiresAt != 0 {
+		expiresAt := time.Unix(0, int64(msg.ExpiresAt))
+		env.ExpiresAt = &expiresAt
+	}
+	return env
+}
+
+type publishResult struct {
+	Id string `json:"id"`
+}
+
+// Publish appends a new message with the given data to the stream and returns its id.
+func (c *Client) Publish(sname string, data interface{}) (string, error) {
+	return c.PublishMessage(&core.Message{Stream: sname, Data: data})
+}
+
+// PublishDelayed appends a new message with the given data to the stream, which only becomes
+// visible to consumers after the given delay. It returns the id of the message.
+func (c *Client) PublishDelayed(sname string, data interface{}, delay time.Duration) (string, error) {
+	return c.PublishMessage(&core.Message{
+		Stream:    sname,
+		DeliverAt: uint64(time.Now().Add(delay).UnixNano()),
+		Data:      data,
+	})
+}
+
+// PublishWithTTL appends a new message with the given data to the stream, which is discarded
+// if not delivered within ttl. It returns the id of the message.
+func (c *Client) PublishWithTTL(sname string, data interface{}, ttl time.Duration) (string, error) {
+	return c.PublishMessage(&core.Message{
+		Stream:    sname,
+		ExpiresAt: uint64(time.Now().Add(ttl).UnixNano()),
+		Data:      data,
+	})
+}
+
+// PublishMessage appends msg to msg.Stream, along with its metadata, and returns the id assigned to it.
+// If msg has an idempotency key, retrying the publish is safe: if the message has already been appended,
+// the id of the original message is returned.
+func (c *Client) PublishMessage(msg *core.Message) (string, error) {
+	return c.PublishMessageContext(context.Background(), msg)
+}
+
+// PublishMessageContext is like PublishMessage, but the W3C trace context of ctx (if any) is propagated
+// to the broker, which stores it inside the message headers. Consumers can then retrieve it through core.MessageContext.
+func (c *Client) PublishMessageContext(ctx context.Context, msg *core.Message) (string, error) {
+	data, err := json.Marshal(newEnvelope(msg))
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/streams/%s", c.baseURL(), msg.Stream), bytes.NewBuffer(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", envelopeContentType)
+	propagation.TraceContext{}.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := c.do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to publish message to stream %s", msg.Stream)
+	}
+
+	res := &publishResult{}
+	err = json.NewDecoder(resp.Body).Decode(res)
+	return res.Id, err
+}
+
+// inboxIdleTimeout bounds the lifetime of inbox streams which are not explicitly deleted (e.g. because of a crash).
+const inboxIdleTimeout = time.Minute
+
+type reply struct {
+	msg *core.Message
+	err error
+}
+
+// Request publishes a message to the given stream and waits for a reply, until ctx is done.
+// Replies are received through an ephemeral inbox stream, which is deleted once the request completes.
+// Responders are expected to answer through the Reply method.
+func (c *Client) Request(ctx context.Context, stream string, data interface{}) (*core.Message, error) {
+	inbox := "_inbox." + uuid.NewV4().String()
+	err := c.CreateStreamWithOptions(inbox, &core.StreamOptions{IdleTimeout: core.Duration(inboxIdleTimeout)})
+	if err != nil {
+		return nil, err
+	}
+	defer c.DeleteStream(inbox)
+
+	consumer := NewConsumer(&ConsumerConfig{Host: c.conf.Host, Namespace: c.conf.Namespace, Credentials: c.conf.Credentials, TLS: c.conf.TLS})
+	if err := consumer.Subscribe(inbox); err != nil {
+		return nil, err
+	}
+	defer consumer.Close()
+
+	correlationId := uuid.NewV4().String()
+	_, err = c.PublishMessageContext(ctx, &core.Message{
+		Stream:        stream,
+		ReplyTo:       inbox,
+		CorrelationId: correlationId,
+		Data:          data,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	replies := make(chan *reply, 1)
+	go func() {
+		for {
+			msg, err := consumer.Listen()
+			if err != nil || msg.CorrelationId == correlationId {
+				replies <- &reply{msg: msg, err: err}
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-replies:
+		return r.msg, r.err
+	}
+}
+
+// Reply answers a message received through a subscription, which has been sent by Request.
+func (c *Client) Reply(req *core.Message, data interface{}) error {
+	if req.ReplyTo == "" {
+		return fmt.Errorf("message %s doesn't expect a reply", req.Id)
+	}
+
+	// the reply continues the trace of the request
+	_, err := c.PublishMessageContext(core.MessageContext(context.Background(), req), &core.Message{
+		Stream:        req.ReplyTo,
+		CorrelationId: req.CorrelationId,
+		Data:          data,
+	})
+	return err
+}
+
+type txEntry struct {
+	Stream string `json:"stream"`
+	*envelope
+}
+
+// PublishTx atomically publishes a batch of messages, possibly targeting different streams:
+// either all of them are appended, or none is. It returns the ids assigned to the messages, in order.
+func (c *Client) PublishTx(msgs []*core.Message) ([]string, error) {
+	entries := make([]*txEntry, 0, len(msgs))
+	for _, msg := range msgs {
+		entries = append(entries, &txEntry{Stream: msg.Stream, envelope: newEnvelope(msg)})
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.post(fmt.Sprintf("%s/tx", c.baseURL()), "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to publish transaction")
+	}
+
+	res := make([]*publishResult, 0)
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(res))
+	for _, r := range res {
+		ids = append(ids, r.Id)
+	}
+	return ids, nil
+}
+
+// ReadStream fetches up to count messages (all of them, if count is zero) of the stream, starting right after
+// the message with the given id (or from the beginning, if after is empty). If filter is not nil,
+// only messages satisfying it are returned.
+func (c *Client) ReadStream(sname string, after string, count int, filter *core.Filter) ([]*core.Message, error) {
+	query := url.Values{}
+	if after != "" {
+		query.Set("after", after)
+	}
+	return c.readMessages(sname, query, count, filter)
+}
+
+// ReadPartition fetches up to count messages (all of them, if count is zero) of a stream partition,
+// starting from the given offset. If filter is not nil, only messages satisfying it are returned.
+func (c *Client) ReadPartition(sname string, partition int, offset uint64, count int, filter *core.Filter) ([]*core.Message, error) {
+	query := url.Values{}
+	query.Set("partition", strconv.Itoa(partition))
+	query.Set("offset", strconv.FormatUint(offset, 10))
+	return c.readMessages(sname, query, count, filter)
+}
+
+func (c *Client) readMessages(sname string, query url.Values, count int, filter *core.Filter) ([]*core.Message, error) {
+	if count > 0 {
+		query.Set("count", strconv.Itoa(count))
+	}
+	if filter != nil {
+		data, err := json.Marshal(filter)
+		if err != nil {
+			return nil, err
+		}
+		query.Set("filter", string(data))
+	}
+
+	resp, err := c.get(fmt.Sprintf("%s/streams/%s?%s", c.baseURL(), sname, query.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to read messages from stream %s", sname)
+	}
+
+	msgs := make([]*core.Message, 0)
+	err = json.NewDecoder(resp.Body).Decode(&msgs)
+	return msgs, err
+}
+
 func (c *Client) ListPendingQueue(sname string, group string) ([]string, error) {
-	resp, err := http.Get(fmt.Sprintf("%s/streams/%s/messages/pending?cgroup=%s", c.conf.Host, sname, group))
+	resp, err := c.get(fmt.Sprintf("%s/streams/%s/messages/pending?cgroup=%s", c.baseURL(), sname, group))
 	if err != nil {
 		return nil, err
 	}
@@ -117,7 +687,7 @@ func (c *Client) ListPendingQueue(sname string, group string) ([]string, error)
 }
 
 func (c *Client) GetConsumerGroupInfo(cgroup string) (*core.ConsumerGroupInfo, error) {
-	resp, err := http.Get(fmt.Sprintf("%s/groups/%s", c.conf.Host, cgroup))
+	resp, err := c.get(fmt.Sprintf("%s/groups/%s", c.baseURL(), cgroup))
 	if err != nil {
 		return nil, err
 	}
@@ -126,9 +696,188 @@ func (c *Client) GetConsumerGroupInfo(cgroup string) (*core.ConsumerGroupInfo, e
 	return info, err
 }
 
+// ListConsumerGroups returns the infos of all the consumer groups, including lag and throughput metrics.
+func (c *Client) ListConsumerGroups() ([]*core.ConsumerGroupInfo, error) {
+	resp, err := c.get(fmt.Sprintf("%s/groups", c.baseURL()))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	groups := make([]*core.ConsumerGroupInfo, 0)
+	err = json.NewDecoder(resp.Body).Decode(&groups)
+	return groups, err
+}
+
+// ListACLRules returns the authorization rules of the server.
+func (c *Client) ListACLRules() ([]core.Rule, error) {
+	resp, err := c.get(fmt.Sprintf("%s/acl/rules", c.conf.Host))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to list acl rules")
+	}
+
+	rules := make([]core.Rule, 0)
+	err = json.NewDecoder(resp.Body).Decode(&rules)
+	return rules, err
+}
+
+// AddACLRule adds an authorization rule to the server, and returns it along with its assigned id.
+func (c *Client) AddACLRule(rule core.Rule) (core.Rule, error) {
+	data, err := json.Marshal(rule)
+	if err != nil {
+		return rule, err
+	}
+
+	resp, err := c.post(fmt.Sprintf("%s/acl/rules", c.conf.Host), "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		return rule, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return rule, fmt.Errorf("unable to add acl rule")
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&rule)
+	return rule, err
+}
+
+// SetACLRules replaces all the authorization rules of the server.
+func (c *Client) SetACLRules(rules []core.Rule) error {
+	data, err := json.Marshal(rules)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/acl/rules", c.conf.Host), bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to set acl rules")
+	}
+	return nil
+}
+
+// RemoveACLRule removes the authorization rule with the given id from the server.
+func (c *Client) RemoveACLRule(id uint64) error {
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/acl/rules/%d", c.conf.Host, id), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to remove acl rule %d", id)
+	}
+	return nil
+}
+
+// CreateNamespace creates a namespace on the server, whose streams are subject to the given quotas.
+func (c *Client) CreateNamespace(name string, quotas core.Quotas) error {
+	data, err := json.Marshal(quotas)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/ns/%s", c.conf.Host, name), bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("unable to create namespace \"%s\"", name)
+	}
+	return nil
+}
+
+// DeleteNamespace deletes a namespace, along with all its streams and groups.
+func (c *Client) DeleteNamespace(name string) error {
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/ns/%s", c.conf.Host, name), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to delete namespace \"%s\"", name)
+	}
+	return nil
+}
+
+// GetNamespaceInfo returns the quotas and the resource usage of a namespace.
+func (c *Client) GetNamespaceInfo(name string) (*core.NamespaceInfo, error) {
+	resp, err := c.get(fmt.Sprintf("%s/ns/%s", c.conf.Host, name))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to get info of namespace \"%s\"", name)
+	}
+
+	info := &core.NamespaceInfo{}
+	err = json.NewDecoder(resp.Body).Decode(info)
+	return info, err
+}
+
+// ListNamespaces returns the namespaces of the server which are visible to the client.
+func (c *Client) ListNamespaces() ([]*core.NamespaceInfo, error) {
+	resp, err := c.get(fmt.Sprintf("%s/ns", c.conf.Host))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to list namespaces")
+	}
+
+	infos := make([]*core.NamespaceInfo, 0)
+	err = json.NewDecoder(resp.Body).Decode(&infos)
+	return infos, err
+}
+
 type ConsumerConfig struct {
-	Host  string
-	Group string
+	Host string
+	// Namespace, if set, is the namespace of the streams and groups to subscribe to
+	Namespace string
+	Group     string
+	// Name, if set, identifies the consumer inside its group
+	Name string
+	// Filter, if set, is evaluated by the broker, so that only matching messages are delivered.
+	Filter      *core.Filter
+	Credentials Credentials
+	TLS         *TLSConfig
 }
 
 type subscription struct {
@@ -149,13 +898,35 @@ func NewConsumer(c *ConsumerConfig) *Consumer {
 	}
 }
 
+// Subscribe starts listening for messages on the given stream.
+// The stream name can also be a glob pattern (e.g. "orders.*"), in which case
+// messages from all the matching streams, including the ones created later, are received.
 func (c *Consumer) Subscribe(stream string) error {
-	uri := fmt.Sprintf("%s/streams/%s/messages", c.conf.Host, stream)
+	uri := fmt.Sprintf("%s/streams/%s/messages", namespaceURL(c.conf.Host, c.conf.Namespace), url.PathEscape(stream))
+
+	query := url.Values{}
 	if c.conf.Group != "" {
-		uri += "?cgroup=" + c.conf.Group
+		query.Set("cgroup", c.conf.Group)
+	}
+	if c.conf.Name != "" {
+		query.Set("consumer", c.conf.Name)
+	}
+	if c.conf.Filter != nil {
+		filter, err := json.Marshal(c.conf.Filter)
+		if err != nil {
+			return err
+		}
+		query.Set("filter", string(filter))
+	}
+	if len(query) > 0 {
+		uri += "?" + query.Encode()
+	}
+
+	client, err := newHTTPClient(c.conf.TLS)
+	if err != nil {
+		return err
 	}
 
-	client := &http.Client{}
 	req, err := http.NewRequest("GET", uri, nil)
 	if err != nil {
 		return err
@@ -167,6 +938,7 @@ func (c *Consumer) Subscribe(stream string) error {
 		cancel: cancel,
 	}
 	req = req.WithContext(ctx)
+	c.conf.Credentials.apply(req)
 	resp, err := client.Do(req)
 	if resp != nil {
 		c.s.resp = resp
@@ -175,7 +947,12 @@ func (c *Consumer) Subscribe(stream string) error {
 	return err
 }
 
-var ErrNoActiveSubscription = errors.New("no active subscription")
+var (
+	ErrNoActiveSubscription = errors.New("no active subscription")
+	// ErrServerShutdown is returned by Listen when the server is shutting down.
+	// Consumers should subscribe again to another instance.
+	ErrServerShutdown = errors.New("server is shutting down")
+)
 
 func (c *Consumer) Listen() (*core.Message, error) {
 	if c.s == nil {
@@ -189,6 +966,10 @@ func (c *Consumer) Listen() (*core.Message, error) {
 		}
 
 		jsonText := s.sc.Text()
+		if jsonText == core.ShutdownEvent {
+			return nil, ErrServerShutdown
+		}
+
 		msg := &core.Message{}
 
 		if err := json.Unmarshal([]byte(jsonText), msg); err != nil {
@@ -200,16 +981,33 @@ func (c *Consumer) Listen() (*core.Message, error) {
 }
 
 func (c *Client) Ack(cgroup string, ackMap map[string][]string) error {
+	return c.AckContext(context.Background(), cgroup, ackMap)
+}
+
+// AckContext is like Ack, but the W3C trace context of ctx (if any) is propagated to the broker.
+func (c *Client) AckContext(ctx context.Context, cgroup string, ackMap map[string][]string) error {
 	data, err := json.Marshal(ackMap)
 	if err != nil {
 		return err
 	}
 
-	resp, err := http.Post(fmt.Sprintf("%s/ack?cgroup=%s", c.conf.Host, cgroup), "application/json", bytes.NewBuffer(data))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/ack?cgroup=%s", c.baseURL(), cgroup), bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	propagation.TraceContext{}.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("unable to ack messages")
 	}
-	return err
+	return nil
 }
 
 func (c *Consumer) Close() error {
@@ -1,11 +1,83 @@
 package main
 
 import (
-	"github.com/ostafen/rustle/server"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ostafen/rustle/config"
+	"github.com/ostafen/rustle/server"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 func main() {
-	srv := server.NewHTTPServer(":8080")
-	log.Fatal(srv.ListenAndServe())
+	conf, err := config.Load(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	opts := conf.ServerOptions()
+
+	opts.Logger = log.Default()
+	if conf.Logging.File != "" {
+		f, err := os.OpenFile(conf.Logging.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+
+		opts.Logger = log.New(f, "", log.LstdFlags)
+	}
+
+	if conf.Tracing.Exporter == "stdout" {
+		exporter, err := stdouttrace.New(stdouttrace.WithPrettyPrint())
+		if err != nil {
+			opts.Logger.Fatal(err)
+		}
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter)))
+	}
+
+	srv := server.NewHTTPServer(opts)
+
+	// on SIGTERM (or interrupt), consumers receive their buffered messages before the server exits
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+		<-sig
+
+		if opts.LogLevel <= server.LogInfo {
+			opts.Logger.Printf("shutting down")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout)
+		defer cancel()
+
+		if err := srv.Shutdown(ctx); err != nil {
+			opts.Logger.Printf("unable to shut down gracefully: %s", err)
+		}
+	}()
+
+	if opts.LogLevel <= server.LogInfo {
+		opts.Logger.Printf("listening on %s", conf.Listen)
+	}
+
+	err = srv.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		opts.Logger.Fatal(err)
+	}
+	<-stopped
 }
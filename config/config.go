@@ -0,0 +1,532 @@
+// Package config loads the configuration of the rustle server from a YAML file,
+// environment variables and command line flags, in increasing order of precedence.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/ostafen/rustle/core"
+	"github.com/ostafen/rustle/server"
+	"gopkg.in/yaml.v3"
+)
+
+type TLSConfig struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// ClientCAFile, if set, is the path of the CA bundle used to verify client certificates
+	ClientCAFile string `yaml:"clientCAFile"`
+	// RequireClientCert makes clients without a certificate be rejected
+	RequireClientCert bool `yaml:"requireClientCert"`
+}
+
+func (c *TLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+type BrokerConfig struct {
+	// DefaultRetention is the time after which messages are discarded, unless
+	// their stream specifies a retention of its own (messages are kept forever, if not set)
+	DefaultRetention time.Duration `yaml:"defaultRetention"`
+	// ConsumerBufferSize is the number of messages which can be queued for each consumer
+	ConsumerBufferSize int `yaml:"consumerBufferSize"`
+	// MemoryLimit, if set, bounds the size in bytes of the messages stored inside all the namespaces
+	MemoryLimit int64 `yaml:"memoryLimit"`
+	// MemoryPolicy is either "reject" or "evict", and it applies when MemoryLimit is exceeded
+	MemoryPolicy string `yaml:"memoryPolicy"`
+}
+
+// NamespaceConfig sets the quotas of a namespace. Zero values leave the corresponding resource unlimited.
+type NamespaceConfig struct {
+	MaxStreams     int     `yaml:"maxStreams"`
+	MaxBytes       int     `yaml:"maxBytes"`
+	MaxPublishRate float64 `yaml:"maxPublishRate"`
+}
+
+func (c *NamespaceConfig) Quotas() core.Quotas {
+	return core.Quotas{
+		MaxStreams:     c.MaxStreams,
+		MaxBytes:       c.MaxBytes,
+		MaxPublishRate: c.MaxPublishRate,
+	}
+}
+
+// LimitsConfig bounds the load of producers. Zero values disable the corresponding limit.
+type LimitsConfig struct {
+	// GlobalRate, PrincipalRate and StreamRate are the maximum number of messages per second
+	// published to the whole server, by each principal and to each stream
+	GlobalRate    float64 `yaml:"globalRate"`
+	PrincipalRate float64 `yaml:"principalRate"`
+	StreamRate    float64 `yaml:"streamRate"`
+	// MaxMessageSize and MaxRequestBody are expressed in bytes
+	MaxMessageSize int   `yaml:"maxMessageSize"`
+	MaxRequestBody int64 `yaml:"maxRequestBody"`
+}
+
+func (c *LimitsConfig) RateLimits() server.RateLimits {
+	return server.RateLimits{
+		GlobalRate:     c.GlobalRate,
+		PrincipalRate:  c.PrincipalRate,
+		StreamRate:     c.StreamRate,
+		MaxMessageSize: c.MaxMessageSize,
+		MaxRequestBody: c.MaxRequestBody,
+	}
+}
+
+type LoggingConfig struct {
+	// Level is one of "debug", "info" and "error"
+	Level string `yaml:"level"`
+	// File is the path of the log file (logs are written to stderr, if not set)
+	File string `yaml:"file"`
+}
+
+type TracingConfig struct {
+	// Exporter is the exporter of trace spans: either "stdout" or empty, to disable tracing
+	Exporter string `yaml:"exporter"`
+}
+
+type MetricsConfig struct {
+	// RequireAuth makes /metrics require credentials of a principal having the admin permission.
+	// Otherwise, metrics can be scraped without authentication.
+	RequireAuth bool `yaml:"requireAuth"`
+}
+
+type APIKeyConfig struct {
+	Key       string `yaml:"key"`
+	Principal string `yaml:"principal"`
+}
+
+type JWTKeyConfig struct {
+	// Id is matched against the "kid" header of tokens (it defaults to the position of the key inside the list)
+	Id string `yaml:"id"`
+	// Secret is the shared secret of HMAC signed tokens
+	Secret string `yaml:"secret"`
+	// PublicKeyFile is the path of a PEM encoded RSA or Ed25519 public key
+	PublicKeyFile string `yaml:"publicKeyFile"`
+}
+
+type JWTConfig struct {
+	Keys []JWTKeyConfig `yaml:"keys"`
+	// Issuer and Audience, if set, must match the "iss" and "aud" claims of tokens
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"`
+}
+
+// AuthConfig configures the authentication of requests, which is disabled if neither API keys nor JWT keys are set.
+type AuthConfig struct {
+	APIKeys []APIKeyConfig `yaml:"apiKeys"`
+	JWT     JWTConfig      `yaml:"jwt"`
+	// ClientCertificates authenticates clients through their certificate (see TLSConfig.ClientCAFile),
+	// using the common name of the subject as the principal
+	ClientCertificates bool `yaml:"clientCertificates"`
+}
+
+// Authenticators returns the authenticators described by the configuration, reading public keys from disk.
+func (c *AuthConfig) Authenticators() ([]server.Authenticator, error) {
+	authenticators := make([]server.Authenticator, 0, 3)
+	if c.ClientCertificates {
+		authenticators = append(authenticators, server.ClientCertificates{})
+	}
+
+	if len(c.APIKeys) > 0 {
+		keys := make(server.APIKeys, len(c.APIKeys))
+		for _, k := range c.APIKeys {
+			if k.Key == "" || k.Principal == "" {
+				return nil, errors.New("api keys must have both a key and a principal")
+			}
+			keys[k.Key] = k.Principal
+		}
+		authenticators = append(authenticators, keys)
+	}
+
+	if len(c.JWT.Keys) > 0 {
+		verifier := &server.JWTVerifier{
+			Keys:     make(map[string]interface{}, len(c.JWT.Keys)),
+			Issuer:   c.JWT.Issuer,
+			Audience: c.JWT.Audience,
+		}
+
+		for i, k := range c.JWT.Keys {
+			id := k.Id
+			if id == "" {
+				id = strconv.Itoa(i)
+			}
+			if _, ok := verifier.Keys[id]; ok {
+				return nil, fmt.Errorf("duplicate jwt key id \"%s\"", id)
+			}
+
+			key, err := k.load()
+			if err != nil {
+				return nil, err
+			}
+			verifier.Keys[id] = key
+		}
+		authenticators = append(authenticators, verifier)
+	}
+	return authenticators, nil
+}
+
+func (k *JWTKeyConfig) load() (interface{}, error) {
+	if (k.Secret == "") == (k.PublicKeyFile == "") {
+		return nil, errors.New("jwt keys must have either a secret or a public key file")
+	}
+
+	if k.Secret != "" {
+		return []byte(k.Secret), nil
+	}
+
+	data, err := os.ReadFile(k.PublicKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read jwt key: %w", err)
+	}
+
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(data); err == nil {
+		return key, nil
+	}
+	if key, err := jwt.ParseEdPublicKeyFromPEM(data); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s is not a PEM encoded RSA or Ed25519 public key", k.PublicKeyFile)
+}
+
+type RuleConfig struct {
+	Principal   string   `yaml:"principal"`
+	Resource    string   `yaml:"resource"`
+	Permissions []string `yaml:"permissions"`
+}
+
+// ACLConfig configures the authorization of requests, which is enabled if some rule is set.
+type ACLConfig struct {
+	Rules []RuleConfig `yaml:"rules"`
+}
+
+// ACL returns the ACL holding the configured rules, or nil if authorization is disabled.
+func (c *ACLConfig) ACL() (*core.ACL, error) {
+	if len(c.Rules) == 0 {
+		return nil, nil
+	}
+
+	rules := make([]core.Rule, 0, len(c.Rules))
+	for _, r := range c.Rules {
+		rule := core.Rule{Principal: r.Principal, Resource: r.Resource}
+		for _, perm := range r.Permissions {
+			rule.Permissions = append(rule.Permissions, core.Permission(perm))
+		}
+		rules = append(rules, rule)
+	}
+	return core.NewACL(rules)
+}
+
+type Config struct {
+	Listen string    `yaml:"listen"`
+	TLS    TLSConfig `yaml:"tls"`
+	// ShutdownTimeout bounds the time spent delivering buffered messages to consumers on shutdown
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+	Broker          BrokerConfig  `yaml:"broker"`
+	// Namespaces are created at startup, along with the default one, whose quotas can be set as well
+	Namespaces map[string]NamespaceConfig `yaml:"namespaces"`
+	Limits     LimitsConfig               `yaml:"limits"`
+	Auth       AuthConfig                 `yaml:"auth"`
+	ACL        ACLConfig                  `yaml:"acl"`
+	Logging    LoggingConfig              `yaml:"logging"`
+	Tracing    TracingConfig              `yaml:"tracing"`
+	Metrics    MetricsConfig              `yaml:"metrics"`
+}
+
+func Default() *Config {
+	return &Config{
+		Listen:          ":8080",
+		ShutdownTimeout: 30 * time.Second,
+		Broker: BrokerConfig{
+			ConsumerBufferSize: 1024,
+			MemoryPolicy:       string(core.MemoryReject),
+		},
+		Logging: LoggingConfig{
+			Level: "info",
+		},
+	}
+}
+
+// setting is a configuration value which can be overridden through a flag and an environment variable.
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+var settings = []setting{
+	{"listen", "RUSTLE_LISTEN", "address to listen on", func(c *Config, v string) error {
+		c.Listen = v
+		return nil
+	}},
+	{"tls-cert", "RUSTLE_TLS_CERT", "path of the TLS certificate", func(c *Config, v string) error {
+		c.TLS.CertFile = v
+		return nil
+	}},
+	{"tls-key", "RUSTLE_TLS_KEY", "path of the TLS private key", func(c *Config, v string) error {
+		c.TLS.KeyFile = v
+		return nil
+	}},
+	{"tls-client-ca", "RUSTLE_TLS_CLIENT_CA", "path of the CA bundle used to verify client certificates", func(c *Config, v string) error {
+		c.TLS.ClientCAFile = v
+		return nil
+	}},
+	{"shutdown-timeout", "RUSTLE_SHUTDOWN_TIMEOUT", "time allowed for a graceful shutdown (e.g. 30s)", func(c *Config, v string) (err error) {
+		c.ShutdownTimeout, err = time.ParseDuration(v)
+		return err
+	}},
+	{"default-retention", "RUSTLE_DEFAULT_RETENTION", "time after which messages are discarded (e.g. 24h)", func(c *Config, v string) (err error) {
+		c.Broker.DefaultRetention, err = time.ParseDuration(v)
+		return err
+	}},
+	{"consumer-buffer-size", "RUSTLE_CONSUMER_BUFFER_SIZE", "number of messages which can be queued for each consumer", func(c *Config, v string) (err error) {
+		c.Broker.ConsumerBufferSize, err = strconv.Atoi(v)
+		return err
+	}},
+	{"max-message-size", "RUSTLE_MAX_MESSAGE_SIZE", "maximum size of a message, in bytes", func(c *Config, v string) (err error) {
+		c.Limits.MaxMessageSize, err = strconv.Atoi(v)
+		return err
+	}},
+	{"max-request-body", "RUSTLE_MAX_REQUEST_BODY", "maximum size of the body of publish requests, in bytes", func(c *Config, v string) (err error) {
+		c.Limits.MaxRequestBody, err = strconv.ParseInt(v, 10, 64)
+		return err
+	}},
+	{"memory-limit", "RUSTLE_MEMORY_LIMIT", "maximum size of the stored messages, in bytes", func(c *Config, v string) (err error) {
+		c.Broker.MemoryLimit, err = strconv.ParseInt(v, 10, 64)
+		return err
+	}},
+	{"memory-policy", "RUSTLE_MEMORY_POLICY", "behavior when the memory limit is exceeded (reject or evict)", func(c *Config, v string) error {
+		c.Broker.MemoryPolicy = v
+		return nil
+	}},
+	{"api-keys", "RUSTLE_API_KEYS", "comma separated list of API keys, as principal:key pairs", func(c *Config, v string) error {
+		c.Auth.APIKeys = nil
+		for _, pair := range strings.Split(v, ",") {
+			principal, key, ok := strings.Cut(pair, ":")
+			if !ok {
+				return errors.New("expected a principal:key pair")
+			}
+			c.Auth.APIKeys = append(c.Auth.APIKeys, APIKeyConfig{Key: key, Principal: principal})
+		}
+		return nil
+	}},
+	{"log-level", "RUSTLE_LOG_LEVEL", "log level (debug, info or error)", func(c *Config, v string) error {
+		c.Logging.Level = v
+		return nil
+	}},
+	{"log-file", "RUSTLE_LOG_FILE", "path of the log file", func(c *Config, v string) error {
+		c.Logging.File = v
+		return nil
+	}},
+	{"tracing", "RUSTLE_TRACING", "exporter of trace spans (stdout)", func(c *Config, v string) error {
+		c.Tracing.Exporter = v
+		return nil
+	}},
+}
+
+// Load builds the configuration from the command line arguments (excluding the program name) and
+// the environment. The path of the configuration file can be supplied through the -config flag or
+// the RUSTLE_CONFIG environment variable. Values set through environment variables override
+// the ones of the file, and flags override both.
+func Load(args []string, getenv func(string) string) (*Config, error) {
+	fs := flag.NewFlagSet("rustle", flag.ContinueOnError)
+	path := fs.String("config", "", "path of the YAML configuration file")
+	for _, s := range settings {
+		fs.String(s.flag, "", fmt.Sprintf("%s (env %s)", s.usage, s.env))
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	conf := Default()
+
+	if *path == "" {
+		*path = getenv("RUSTLE_CONFIG")
+	}
+	if *path != "" {
+		if err := conf.readFile(*path); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range settings {
+		if value := getenv(s.env); value != "" {
+			if err := s.set(conf, value); err != nil {
+				return nil, fmt.Errorf("invalid value \"%s\" of %s: %w", value, s.env, err)
+			}
+		}
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name && err == nil {
+				if setErr := s.set(conf, f.Value.String()); setErr != nil {
+					err = fmt.Errorf("invalid value \"%s\" of flag -%s: %w", f.Value, f.Name, setErr)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// readFile decodes the YAML file at the given path on top of the current configuration.
+// Unknown keys are reported as errors, so that typos are not silently ignored.
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read configuration file: %w", err)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid configuration file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate checks the whole configuration, reporting all the invalid values at once.
+func (c *Config) Validate() error {
+	problems := make([]string, 0)
+
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		problems = append(problems, fmt.Sprintf("listen: invalid address \"%s\"", c.Listen))
+	}
+
+	if c.TLS.Enabled() {
+		if c.TLS.CertFile == "" || c.TLS.KeyFile == "" {
+			problems = append(problems, "tls: certFile and keyFile must be set together")
+		}
+		for _, file := range []string{c.TLS.CertFile, c.TLS.KeyFile, c.TLS.ClientCAFile} {
+			if _, err := os.Stat(file); file != "" && err != nil {
+				problems = append(problems, fmt.Sprintf("tls: unable to access %s", file))
+			}
+		}
+	}
+
+	if !c.TLS.Enabled() && c.TLS.ClientCAFile != "" {
+		problems = append(problems, "tls: clientCAFile requires certFile and keyFile")
+	}
+	if (c.TLS.RequireClientCert || c.Auth.ClientCertificates) && c.TLS.ClientCAFile == "" {
+		problems = append(problems, "tls: client certificates require clientCAFile")
+	}
+
+	if c.ShutdownTimeout <= 0 {
+		problems = append(problems, "shutdownTimeout: must be positive")
+	}
+
+	if c.Broker.DefaultRetention < 0 {
+		problems = append(problems, "broker.defaultRetention: must not be negative")
+	}
+	if c.Broker.ConsumerBufferSize <= 0 {
+		problems = append(problems, "broker.consumerBufferSize: must be positive")
+	}
+	if c.Broker.MemoryLimit < 0 {
+		problems = append(problems, "broker.memoryLimit: must not be negative")
+	}
+	if err := core.MemoryPolicy(c.Broker.MemoryPolicy).Validate(); err != nil {
+		problems = append(problems, fmt.Sprintf("broker.memoryPolicy: unknown policy \"%s\"", c.Broker.MemoryPolicy))
+	}
+
+	for name, ns := range c.Namespaces {
+		if err := server.ValidateNamespace(name); err != nil {
+			problems = append(problems, fmt.Sprintf("namespaces: invalid name \"%s\"", name))
+		}
+
+		quotas := ns.Quotas()
+		if err := quotas.Validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("namespaces.%s: %s", name, err))
+		}
+	}
+
+	limits := c.Limits.RateLimits()
+	if err := limits.Validate(); err != nil {
+		problems = append(problems, "limits: must not be negative")
+	}
+
+	if _, err := c.Auth.Authenticators(); err != nil {
+		problems = append(problems, "auth: "+err.Error())
+	}
+
+	if _, err := c.ACL.ACL(); err != nil {
+		problems = append(problems, "acl: "+err.Error())
+	}
+
+	if _, err := server.ParseLogLevel(c.Logging.Level); err != nil {
+		problems = append(problems, "logging.level: "+err.Error())
+	}
+
+	if c.Tracing.Exporter != "" && c.Tracing.Exporter != "stdout" {
+		problems = append(problems, fmt.Sprintf("tracing.exporter: unknown exporter \"%s\"", c.Tracing.Exporter))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// ServerOptions returns the options of the http server described by the configuration.
+// The logger is not set, since it depends on the log file being opened.
+func (c *Config) ServerOptions() *server.Options {
+	level, _ := server.ParseLogLevel(c.Logging.Level)
+	authenticators, _ := c.Auth.Authenticators()
+	acl, _ := c.ACL.ACL()
+
+	var tlsOpts *server.TLSOptions
+	if c.TLS.Enabled() {
+		tlsOpts = &server.TLSOptions{
+			CertFile:          c.TLS.CertFile,
+			KeyFile:           c.TLS.KeyFile,
+			ClientCAFile:      c.TLS.ClientCAFile,
+			RequireClientCert: c.TLS.RequireClientCert,
+		}
+	}
+
+	defaultNs := c.Namespaces[server.DefaultNamespace]
+	namespaces := make(map[string]core.Quotas, len(c.Namespaces))
+	for name, ns := range c.Namespaces {
+		namespaces[name] = ns.Quotas()
+	}
+
+	var memory *core.MemoryBudget
+	if c.Broker.MemoryLimit > 0 {
+		memory = core.NewMemoryBudget(c.Broker.MemoryLimit, core.MemoryPolicy(c.Broker.MemoryPolicy))
+	}
+
+	return &server.Options{
+		Addr: c.Listen,
+		Broker: core.BrokerOptions{
+			ConsumerBufferSize: c.Broker.ConsumerBufferSize,
+			DefaultRetention:   c.Broker.DefaultRetention,
+			Quotas:             defaultNs.Quotas(),
+			Memory:             memory,
+		},
+		Namespaces:     namespaces,
+		RateLimits:     c.Limits.RateLimits(),
+		LogLevel:       level,
+		Authenticators: authenticators,
+		ACL:            acl,
+		TLS:            tlsOpts,
+		MetricsAuth:    c.Metrics.RequireAuth,
+	}
+}
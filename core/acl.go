@@ -0,0 +1,230 @@
+package core
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+// Permission is an operation which can be granted to principals on streams and groups.
+type Permission string
+
+const (
+	PermCreate    Permission = "create"
+	PermDelete    Permission = "delete"
+	PermPublish   Permission = "publish"
+	PermSubscribe Permission = "subscribe"
+	PermAck       Permission = "ack"
+	// PermAdmin grants all the other permissions, as well as the management of consumer groups
+	// (moving cursors and removing consumers). On the broker itself, it grants the management of rules.
+	PermAdmin Permission = "admin"
+)
+
+const (
+	// AnyPrincipal matches every principal, including anonymous clients
+	AnyPrincipal = "*"
+	// AnyResource matches all the streams and groups, as well as the broker itself
+	AnyResource = "*"
+	// BrokerResource identifies the broker itself, and it is only matched by AnyResource
+	BrokerResource = ""
+)
+
+// StreamResource returns the resource identifying a stream (or a glob pattern of stream names) inside rules.
+func StreamResource(name string) string {
+	return "stream:" + name
+}
+
+// NamespaceResource returns the resource identifying a namespace (or a glob pattern of namespace names) inside rules.
+func NamespaceResource(name string) string {
+	return "namespace:" + name
+}
+
+// GroupResource returns the resource identifying a consumer group (or a glob pattern of group names) inside rules.
+func GroupResource(name string) string {
+	return "group:" + name
+}
+
+var ErrInvalidRule = errors.New("invalid acl rule")
+
+// Rule grants a set of permissions to a principal on the resources matching a pattern
+// (e.g. "stream:orders.*", "group:billing" or AnyResource).
+type Rule struct {
+	Id          uint64       `json:"id"`
+	Principal   string       `json:"principal"`
+	Resource    string       `json:"resource"`
+	Permissions []Permission `json:"permissions"`
+}
+
+func (rule *Rule) Validate() error {
+	if rule.Principal == "" || len(rule.Permissions) == 0 {
+		return ErrInvalidRule
+	}
+
+	for _, perm := range rule.Permissions {
+		switch perm {
+		case PermCreate, PermDelete, PermPublish, PermSubscribe, PermAck, PermAdmin:
+		default:
+			return ErrInvalidRule
+		}
+	}
+
+	if rule.Resource == AnyResource {
+		return nil
+	}
+
+	kind, pattern, ok := strings.Cut(rule.Resource, ":")
+	if !ok || (kind != "stream" && kind != "group" && kind != "namespace") || pattern == "" || validatePattern(pattern) != nil {
+		return ErrInvalidRule
+	}
+	return nil
+}
+
+func (rule *Rule) matches(principal string, resource string) bool {
+	if rule.Principal != AnyPrincipal && rule.Principal != principal {
+		return false
+	}
+
+	if rule.Resource == AnyResource {
+		return true
+	}
+
+	kind, pattern, _ := strings.Cut(rule.Resource, ":")
+	resourceKind, name, ok := strings.Cut(resource, ":")
+	if !ok || kind != resourceKind {
+		return false
+	}
+
+	// a requested pattern (e.g. when subscribing to "orders.*") must be matched as a whole
+	if IsPattern(name) {
+		return covers(pattern, name)
+	}
+	return matchPattern(pattern, name)
+}
+
+// covers reports whether all the names matching requested also match the pattern of a rule. Since this can't
+// be decided in general, requested is only covered by an identical pattern, or by a pattern made of a literal
+// prefix of requested followed by a single "*" (e.g. "orders.*" covers "orders.eu.?"), provided that the rest
+// of requested can't match a "/" (which is never matched by "*").
+func covers(pattern string, requested string) bool {
+	if pattern == requested {
+		return true
+	}
+
+	prefix := strings.TrimSuffix(pattern, "*")
+	if prefix == pattern || IsPattern(prefix) || !strings.HasPrefix(requested, prefix) {
+		return false
+	}
+	return !strings.ContainsAny(requested[len(prefix):], "/[\\")
+}
+
+func (rule *Rule) grants(perm Permission) bool {
+	for _, p := range rule.Permissions {
+		if p == perm || p == PermAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// ACL is a set of rules granting permissions to principals. Any access which is not granted by a rule is denied.
+// Rules can be changed at any time, and they are safe for concurrent use.
+type ACL struct {
+	mu     sync.RWMutex
+	nextId uint64
+	rules  []Rule
+}
+
+// NewACL creates an ACL holding the given rules. Ids are assigned to rules in order.
+func NewACL(rules []Rule) (*ACL, error) {
+	acl := &ACL{}
+	if err := acl.SetRules(rules); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// Allowed reports whether principal has the given permission on a resource (see StreamResource and GroupResource).
+func (acl *ACL) Allowed(principal string, perm Permission, resource string) bool {
+	acl.mu.RLock()
+	defer acl.mu.RUnlock()
+
+	for i := range acl.rules {
+		if acl.rules[i].matches(principal, resource) && acl.rules[i].grants(perm) {
+			return true
+		}
+	}
+	return false
+}
+
+// Visible reports whether principal has any permission on a resource.
+func (acl *ACL) Visible(principal string, resource string) bool {
+	acl.mu.RLock()
+	defer acl.mu.RUnlock()
+
+	for i := range acl.rules {
+		if acl.rules[i].matches(principal, resource) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rules returns a copy of the current rules.
+func (acl *ACL) Rules() []Rule {
+	acl.mu.RLock()
+	defer acl.mu.RUnlock()
+
+	rules := make([]Rule, len(acl.rules))
+	copy(rules, acl.rules)
+	return rules
+}
+
+// AddRule appends a rule to the ACL, and returns it along with its assigned id.
+func (acl *ACL) AddRule(rule Rule) (Rule, error) {
+	if err := rule.Validate(); err != nil {
+		return rule, err
+	}
+
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+
+	rule.Id = acl.nextId
+	acl.nextId++
+	acl.rules = append(acl.rules, rule)
+	return rule, nil
+}
+
+// RemoveRule removes the rule with the given id, reporting whether it existed.
+func (acl *ACL) RemoveRule(id uint64) bool {
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+
+	for i, rule := range acl.rules {
+		if rule.Id == id {
+			acl.rules = append(acl.rules[:i], acl.rules[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// SetRules replaces all the rules of the ACL, assigning new ids to them.
+// If some rule is invalid, the ACL is left untouched.
+func (acl *ACL) SetRules(rules []Rule) error {
+	for i := range rules {
+		if err := rules[i].Validate(); err != nil {
+			return err
+		}
+	}
+
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+
+	acl.rules = make([]Rule, 0, len(rules))
+	for _, rule := range rules {
+		rule.Id = acl.nextId
+		acl.nextId++
+		acl.rules = append(acl.rules, rule)
+	}
+	return nil
+}
@@ -1,27 +1,151 @@
 package core
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+const defaultConsumerBufferSize = 1024
+
+var ErrInvalidBrokerOptions = errors.New("invalid broker options")
+
+// Quotas bound the resources used by a broker. Zero values mean no limit.
+type Quotas struct {
+	MaxStreams int `json:"maxStreams,omitempty"`
+	// MaxBytes bounds the approximate size of the messages stored inside all the streams
+	MaxBytes int `json:"maxBytes,omitempty"`
+	// MaxPublishRate is the number of messages which can be published per second, on average.
+	// Bursts of up to one second worth of messages are allowed.
+	MaxPublishRate float64 `json:"maxPublishRate,omitempty"`
+}
+
+func (q *Quotas) Validate() error {
+	if q.MaxStreams < 0 || q.MaxBytes < 0 || q.MaxPublishRate < 0 {
+		return ErrInvalidBrokerOptions
+	}
+	return nil
+}
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Names of the quotas reported by QuotaError.
+const (
+	QuotaStreams     = "stream count"
+	QuotaMemory      = "memory"
+	QuotaPublishRate = "publish rate"
+)
+
+// QuotaError is returned when an operation would exceed one of the quotas of the broker.
+// It matches ErrQuotaExceeded.
+type QuotaError struct {
+	Quota string
+	// RetryAfter, if not zero, is the time after which the operation could succeed
+	RetryAfter time.Duration
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s quota exceeded", e.Quota)
+}
+
+func (e *QuotaError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+type BrokerOptions struct {
+	// ConsumerBufferSize is the number of messages which can be queued for each consumer (1024, if not set).
+	// Once the buffer of a consumer is full, messages dispatched to it are held inside their stream
+	// until the consumer frees some space, so that slow consumers never block publishers.
+	ConsumerBufferSize int
+	// DefaultRetention, if set, is the time after which messages are discarded, for streams
+	// which don't specify a retention of their own. Retention is enforced by periodically trimming
+	// the head of streams, and it doesn't affect messages having a TTL.
+	DefaultRetention time.Duration
+	Quotas           Quotas
+	// Memory, if set, bounds the size of the stored messages. It can be shared by several brokers,
+	// in which case eviction reclaims memory from all of them (see MemoryEvict).
+	Memory *MemoryBudget
+}
+
+func (opts *BrokerOptions) Validate() error {
+	if opts.ConsumerBufferSize < 0 || opts.DefaultRetention < 0 {
+		return ErrInvalidBrokerOptions
+	}
+	if opts.Memory != nil {
+		if err := opts.Memory.validate(); err != nil {
+			return err
+		}
+	}
+	return opts.Quotas.Validate()
+}
+
 type Broker struct {
 	mu      sync.Mutex
+	opts    BrokerOptions
 	streams map[string]*stream
 	cGroups map[string]*consumerGroup
+	timers  *timerQueue
+	// publishRate enforces the MaxPublishRate quota, if set
+	publishRate *TokenBucket
+	// closing is set once the broker starts shutting down
+	closing bool
 }
 
-func NewBroker() *Broker {
-	return &Broker{
+// NewBroker creates a new broker with the given options (defaults are used if opts is nil).
+func NewBroker(opts *BrokerOptions) *Broker {
+	if opts == nil {
+		opts = &BrokerOptions{}
+	}
+
+	b := &Broker{
+		opts:    *opts,
 		streams: make(map[string]*stream),
 		cGroups: make(map[string]*consumerGroup),
 	}
+	if b.opts.ConsumerBufferSize == 0 {
+		b.opts.ConsumerBufferSize = defaultConsumerBufferSize
+	}
+	if rate := b.opts.Quotas.MaxPublishRate; rate > 0 {
+		b.publishRate = NewTokenBucket(rate, math.Max(rate, 1), time.Now().UnixNano())
+	}
+	b.timers = newTimerQueue(b.fireTimers)
+	b.opts.Memory.attach(b)
+	return b
+}
+
+// Quotas returns the quotas of the broker.
+func (b *Broker) Quotas() Quotas {
+	return b.opts.Quotas
+}
+
+func (b *Broker) fireTimers() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.timers.runDue()
 }
 
 type StreamInfo struct {
-	Name string `json:"name"`
+	Name       string `json:"name"`
+	Length     int    `json:"length"`
+	Partitions int    `json:"partitions"`
+	// Bytes is the approximate size of the messages stored inside the stream
+	Bytes int `json:"bytes"`
+	// Published is the total number of messages appended to the stream
+	Published uint64 `json:"published"`
+	// Scheduled is the number of delayed messages which have not been released yet
+	Scheduled int `json:"scheduled"`
+	// Deleted is the number of messages which have been explicitly deleted from the stream
+	Deleted int `json:"deleted"`
 	// TODO: add other infos
 }
 
@@ -30,39 +154,165 @@ func (b *Broker) ListStreams() []StreamInfo {
 	defer b.mu.Unlock()
 
 	streams := make([]StreamInfo, 0, len(b.streams))
-	for name := range b.streams {
+	for name, s := range b.streams {
 		streams = append(streams, StreamInfo{
-			Name: name,
+			Name:       name,
+			Length:     s.length,
+			Partitions: len(s.partitions),
+			Bytes:      s.bytes,
+			Published:  s.published,
+			Scheduled:  s.scheduled,
+			Deleted:    s.deleted,
 		})
 	}
 	return streams
 }
 
 type ConsumerInfo struct {
-	Id uint64 `json:"id"`
+	Id   uint64 `json:"id"`
+	Name string `json:"name"`
+	// Buffered is the number of messages waiting to be sent to the consumer
+	Buffered int `json:"buffered"`
+}
+
+// GroupStreamInfo describes the state of a consumer group on one of the streams it is bound to.
+type GroupStreamInfo struct {
+	Stream          string `json:"stream"`
+	LastDeliveredId string `json:"lastDeliveredId"`
+	// Lag is the number of messages of the stream which have not been delivered to the group yet
+	Lag     int `json:"lag"`
+	Pending int `json:"pending"`
+	// OldestPendingAge is the time elapsed since the delivery of the oldest pending message
+	OldestPendingAge Duration `json:"oldestPendingAge"`
+	// Delivered and Acked are the total number of messages delivered to and acked by the group
+	Delivered uint64 `json:"delivered"`
+	Acked     uint64 `json:"acked"`
+	// Redelivered is the number of messages delivered again after moving the cursor back, while
+	// Nacked is the number of messages whose delivery has been rejected (e.g. by a webhook)
+	Redelivered uint64 `json:"redelivered"`
+	Nacked      uint64 `json:"nacked"`
+	// Throughput is the average number of messages acked per second, over the last minute
+	Throughput float64 `json:"throughput"`
 }
 
 type ConsumerGroupInfo struct {
-	Consumers []ConsumerInfo `json:"consumers"`
+	Name      string            `json:"name"`
+	Options   GroupOptions      `json:"options"`
+	Consumers []ConsumerInfo    `json:"consumers"`
+	Streams   []GroupStreamInfo `json:"streams"`
 }
 
 func (b *Broker) GetConsumerGroupInfos(name string) (*ConsumerGroupInfo, error) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	if _, ok := b.cGroups[name]; !ok {
+	group, ok := b.cGroups[name]
+	if !ok {
 		return nil, fmt.Errorf("no consumer group with name \"%s\"", name)
 	}
+	return b.groupInfo(group), nil
+}
+
+// ListGroups returns the infos of all the consumer groups, ordered by name.
+func (b *Broker) ListGroups() []*ConsumerGroupInfo {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
+	groups := make([]*ConsumerGroupInfo, 0, len(b.cGroups))
+	for _, group := range b.cGroups {
+		groups = append(groups, b.groupInfo(group))
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	return groups
+}
+
+func (b *Broker) groupInfo(group *consumerGroup) *ConsumerGroupInfo {
 	cInfos := make([]ConsumerInfo, 0)
-	group := b.cGroups[name]
 	for _, c := range group.consumers {
-		cInfos = append(cInfos, ConsumerInfo{Id: c.id})
+		cInfos = append(cInfos, ConsumerInfo{Id: c.id, Name: c.name, Buffered: len(c.outCh)})
 	}
 
+	now := time.Now().UnixNano()
+
+	sInfos := make([]GroupStreamInfo, 0, len(group.subscriptions))
+	for sname, subscription := range group.subscriptions {
+		info := GroupStreamInfo{
+			Stream:          sname,
+			LastDeliveredId: subscription.lastDelivered,
+			Pending:         len(subscription.pending),
+			Delivered:       subscription.delivered.total,
+			Acked:           subscription.acked.total,
+			Redelivered:     subscription.redelivered,
+			Nacked:          subscription.nacked,
+			Throughput:      subscription.acked.rate(now),
+		}
+
+		info.Lag = subscription.lag
+
+		if oldest := subscription.oldestPending(); oldest > 0 {
+			info.OldestPendingAge = Duration(now - oldest)
+		}
+		sInfos = append(sInfos, info)
+	}
+	sort.Slice(sInfos, func(i, j int) bool {
+		return sInfos[i].Stream < sInfos[j].Stream
+	})
+
 	return &ConsumerGroupInfo{
+		Name:      group.name,
+		Options:   group.opts,
 		Consumers: cInfos,
-	}, nil
+		Streams:   sInfos,
+	}
+}
+
+// BrokerStats summarizes the resources used by a broker.
+type BrokerStats struct {
+	Streams   int `json:"streams"`
+	Groups    int `json:"groups"`
+	Consumers int `json:"consumers"`
+	// Messages and Bytes are the number and the approximate size of the messages stored inside all the streams
+	Messages int `json:"messages"`
+	Bytes    int `json:"bytes"`
+	// Published is the total number of messages appended to the streams which still exist
+	Published uint64 `json:"published"`
+	// Memory reports the usage of the memory budget of the broker, which can be shared with other brokers
+	Memory *MemoryUsage `json:"memory,omitempty"`
+}
+
+// NamespaceInfo describes a namespace of the server, along with the quotas and the usage of its broker.
+type NamespaceInfo struct {
+	Name   string      `json:"name"`
+	Quotas Quotas      `json:"quotas"`
+	Stats  BrokerStats `json:"stats"`
+}
+
+func (b *Broker) Stats() BrokerStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := BrokerStats{
+		Streams: len(b.streams),
+		Groups:  len(b.cGroups),
+	}
+
+	for _, s := range b.streams {
+		stats.Messages += s.length
+		stats.Bytes += s.bytes
+		stats.Published += s.published
+	}
+
+	for _, group := range b.cGroups {
+		stats.Consumers += len(group.consumers)
+	}
+
+	if b.opts.Memory != nil {
+		usage := b.opts.Memory.Usage()
+		stats.Memory = &usage
+	}
+	return stats
 }
 
 func (b *Broker) hasStream(name string) bool {
@@ -77,101 +327,698 @@ func (b *Broker) HasStream(name string) bool {
 	return b.hasStream(name)
 }
 
-func (b *Broker) CreateStream(name string) bool {
+var ErrStreamExists = errors.New("stream already exists")
+
+// CreateStream creates a new stream with the given options (defaults are used if opts is nil).
+// It fails with ErrStreamExists if a stream with the same name already exists.
+func (b *Broker) CreateStream(name string, opts *StreamOptions) error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
+	if IsPattern(name) {
+		return ErrInvalidPattern
+	}
+
 	if b.hasStream(name) {
-		return false
+		return ErrStreamExists
+	}
+
+	if max := b.opts.Quotas.MaxStreams; max > 0 && len(b.streams) >= max {
+		return &QuotaError{Quota: QuotaStreams}
+	}
+
+	if opts == nil {
+		opts = &StreamOptions{}
 	}
 
-	b.streams[name] = newStream()
-	return true
+	s := newStream(*opts)
+	s.budget = b.opts.Memory
+	b.streams[name] = s
+
+	for _, group := range b.cGroups {
+		group.attachStream(name)
+	}
+
+	if opts.IdleTimeout > 0 {
+		b.scheduleIdleCheck(name, s)
+	}
+	return nil
+}
+
+func (b *Broker) scheduleIdleCheck(name string, s *stream) {
+	b.timers.schedule(s.lastActive+int64(s.opts.IdleTimeout), func() {
+		b.checkIdle(name, s)
+	})
+}
+
+// checkIdle deletes an ephemeral stream if it has had no consumers
+// and no new messages for (at least) its idle timeout.
+func (b *Broker) checkIdle(name string, s *stream) {
+	if b.streams[name] != s {
+		return
+	}
+
+	now := time.Now().UnixNano()
+	if b.hasConsumers(name) {
+		s.lastActive = now
+	}
+
+	if s.lastActive+int64(s.opts.IdleTimeout) <= now {
+		b.removeStream(name)
+		return
+	}
+	b.scheduleIdleCheck(name, s)
+}
+
+func (b *Broker) hasConsumers(sname string) bool {
+	for _, group := range b.cGroups {
+		if subscription := group.subscriptions[sname]; subscription != nil && len(subscription.consumers) > 0 {
+			return true
+		}
+	}
+	return false
 }
 
 func (b *Broker) getOrCreateGroup(name string) *consumerGroup {
 	group, ok := b.cGroups[name]
 	if !ok {
-		group = newConsumerGroup(name)
+		group = newConsumerGroup(name, GroupOptions{}, b.opts.ConsumerBufferSize)
 		b.cGroups[name] = group
 	}
 	return group
 }
 
-func (b *Broker) RegisterConsumer(cgroup string, w io.Writer, streams ...string) (*consumer, error) {
+var (
+	ErrConsumerExists = errors.New("consumer already exists")
+	ErrShuttingDown   = errors.New("broker is shutting down")
+)
+
+// RegisterConsumer adds a new consumer to the given group, subscribing it to the
+// supplied streams. Each entry can also be a glob pattern (e.g. "orders.*"):
+// in that case, the consumer is subscribed to all the existing streams matching it,
+// as well as to any matching stream created later.
+// If filter is not nil, only messages satisfying it are delivered to the consumer.
+// Consumer names must be unique inside a group: if name is empty, the consumer is named after its id.
+//
+// Streams which are not yet bound to the group are bound starting from the latest message,
+// while for the other ones the consumer receives the messages following the cursor of the group.
+func (b *Broker) RegisterConsumer(cgroup string, name string, w io.Writer, filter *Filter, streams ...string) (*consumer, error) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	for _, stream := range streams {
-		if !b.hasStream(stream) {
-			return nil, fmt.Errorf("no such stream with name %s", stream)
-		}
+	if b.closing {
+		return nil, ErrShuttingDown
+	}
+
+	names, err := b.resolveStreams(streams)
+	if err != nil {
+		return nil, err
 	}
 
 	group := b.getOrCreateGroup(cgroup)
-	c := group.addConsumerWithSubscriptions(streams)
+	if name != "" && group.getConsumer(name) != nil {
+		return nil, ErrConsumerExists
+	}
+
+	for _, sname := range names {
+		group.bind(sname, b.streams[sname], StartLatest)
+	}
+
+	c := group.addConsumerWithSubscriptions(name, names, streams, filter)
+	c.wake = func() { b.resume(c) }
 	c.start(w)
+
+	group.catchUp(b.streams)
 	return c, nil
 }
 
+// resolveStreams returns the names of all the existing streams matching a list of stream names and glob patterns.
+func (b *Broker) resolveStreams(streams []string) ([]string, error) {
+	names := make([]string, 0, len(streams))
+	patterns := make([]string, 0)
+	for _, stream := range streams {
+		if !IsPattern(stream) {
+			if !b.hasStream(stream) {
+				return nil, fmt.Errorf("no such stream with name %s", stream)
+			}
+			names = append(names, stream)
+			continue
+		}
+
+		if err := validatePattern(stream); err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, stream)
+	}
+
+	for sname := range b.streams {
+		for _, pattern := range patterns {
+			if matchPattern(pattern, sname) && !contains(names, sname) {
+				names = append(names, sname)
+				break
+			}
+		}
+	}
+	return names, nil
+}
+
+// UnregisterConsumer detaches a consumer from its group. It has no effect if the consumer
+// has already been removed, for example because its group has been deleted.
 func (b *Broker) UnregisterConsumer(c *consumer) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	if _, ok := b.cGroups[c.group]; !ok {
-		log.Fatal("trying to detach consumer on a non existing group")
+	group, ok := b.cGroups[c.group]
+	if !ok || group.consumers[c.id] != c {
+		return
 	}
+	group.removeConsumer(c)
 
-	b.cGroups[c.group].removeConsumer(c)
+	// messages held for the consumer are dispatched to the remaining ones
+	group.catchUp(b.streams)
 }
 
-func (b *Broker) NotifyMessage(msg *Message) {
+// resume delivers the messages held for the group of a consumer, once the consumer has freed some space inside its buffer.
+func (b *Broker) resume(c *consumer) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	// check has stream
-	s, ok := b.streams[msg.Stream]
-	if !ok {
+	group, ok := b.cGroups[c.group]
+	if b.closing || !ok || group.consumers[c.id] != c {
 		return
 	}
+	group.catchUp(b.streams)
+}
+
+var ErrWebhookConsumer = errors.New("webhook consumers can't be removed")
+
+// RemoveConsumer disconnects the consumer with the given name from a group.
+// Messages delivered to it and not acked yet remain pending.
+// The consumer pushing to the webhook of a group can't be removed, since it couldn't be restarted.
+func (b *Broker) RemoveConsumer(cgroup string, name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	group, ok := b.cGroups[cgroup]
+	if !ok {
+		return fmt.Errorf("no such group with name %s", cgroup)
+	}
+
+	c := group.getConsumer(name)
+	if c == nil {
+		return fmt.Errorf("no consumer with name %s in group %s", name, cgroup)
+	}
+
+	if c.webhook {
+		return ErrWebhookConsumer
+	}
+
+	group.removeConsumer(c)
+	c.Stop()
+	group.catchUp(b.streams)
+	return nil
+}
+
+// SetGroupCursor moves the cursor of a group on a stream right after the message with the given id
+// (see StartLatest and StartEarliest), binding the group to the stream if needed.
+// Moving the cursor back makes the group receive again the messages following it, while moving it forward
+// skips messages. In both cases, messages which are still pending are left untouched.
+func (b *Broker) SetGroupCursor(cgroup string, sname string, id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	group, ok := b.cGroups[cgroup]
+	if !ok {
+		return fmt.Errorf("no such group with name %s", cgroup)
+	}
+
+	s, ok := b.streams[sname]
+	if !ok {
+		return fmt.Errorf("no such stream with name %s", sname)
+	}
+	return group.setCursor(sname, s, id)
+}
+
+// NotifyMessage appends a message to its stream and dispatches it to consumers.
+// If the message has a DeliverAt instant in the future, it is held by the broker and
+// it only becomes visible, both to readers and consumers, once it is due.
+//
+// If a message with the same idempotency key has been recently published to the stream,
+// the new message is discarded, and the original one is returned along with a true value.
+// Otherwise, msg itself is returned.
+func (b *Broker) NotifyMessage(msg *Message) (*Message, bool, error) {
+	published, duplicates, err := b.NotifyMessages([]*Message{msg})
+	if err != nil {
+		return nil, false, err
+	}
+	return published[0], duplicates[0], nil
+}
+
+// NotifyMessages atomically publishes a batch of messages, possibly targeting different streams:
+// either all the messages are published, or none of them is (for example, because some stream doesn't exist).
+// For each message, the result is the same as the one of NotifyMessage.
+func (b *Broker) NotifyMessages(msgs []*Message) ([]*Message, []bool, error) {
+	// sizes are computed outside the lock, and the messages are charged to the memory budget when admitted
+	size := 0
+	for _, msg := range msgs {
+		msg.size = msg.Size()
+		size += msg.size
+	}
+
+	published, duplicates, err := b.tryPublish(msgs, size)
+	if err == errMemoryShortage && b.opts.Memory.policy == MemoryEvict && int64(size) <= b.opts.Memory.limit {
+		// eviction locks the brokers sharing the budget one at a time, so it runs after the lock has been released
+		b.opts.Memory.evict(size)
+		published, duplicates, err = b.tryPublish(msgs, size)
+	}
+
+	if err == errMemoryShortage {
+		atomic.AddUint64(&b.opts.Memory.rejected, 1)
+		return nil, nil, ErrMemoryExhausted
+	}
+	return published, duplicates, err
+}
+
+func (b *Broker) tryPublish(msgs []*Message, size int) ([]*Message, []bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closing {
+		return nil, nil, ErrShuttingDown
+	}
+
+	for _, msg := range msgs {
+		if !b.hasStream(msg.Stream) {
+			return nil, nil, fmt.Errorf("no such stream with name %s", msg.Stream)
+		}
+	}
+
+	if err := b.checkQuotas(msgs, size); err != nil {
+		return nil, nil, err
+	}
+
+	published := make([]*Message, 0, len(msgs))
+	duplicates := make([]bool, 0, len(msgs))
+	for _, msg := range msgs {
+		original, duplicate := b.publish(b.streams[msg.Stream], msg)
+		if duplicate {
+			b.opts.Memory.add(-msg.size)
+		}
+		published = append(published, original)
+		duplicates = append(duplicates, duplicate)
+	}
+	return published, duplicates, nil
+}
+
+// checkQuotas ensures that publishing size bytes of messages doesn't exceed the quotas and the memory budget
+// of the broker, reserving them in the budget. All the checks run before any of them consumes tokens or memory,
+// and errMemoryShortage is returned if the budget has no room, so that the caller can evict messages.
+func (b *Broker) checkQuotas(msgs []*Message, size int) error {
+	if max := b.opts.Quotas.MaxBytes; max > 0 && b.bytes()+size > max {
+		return &QuotaError{Quota: QuotaMemory}
+	}
+
+	now := time.Now().UnixNano()
+	if b.publishRate != nil {
+		if wait := b.publishRate.Wait(now, float64(len(msgs))); wait > 0 {
+			return &QuotaError{Quota: QuotaPublishRate, RetryAfter: wait}
+		}
+	}
+
+	if !b.opts.Memory.reserve(size) {
+		return errMemoryShortage
+	}
+
+	if b.publishRate != nil {
+		b.publishRate.Take(now, float64(len(msgs)))
+	}
+	return nil
+}
+
+// bytes returns the approximate size of the messages stored inside all the streams.
+func (b *Broker) bytes() int {
+	n := 0
+	for _, s := range b.streams {
+		n += s.bytes
+	}
+	return n
+}
+
+// publish appends a message to its stream, recording a span which is a child of the trace context
+// carried by the message (if any). The message then carries the context of the span itself, so that
+// deliveries are traced as its children.
+func (b *Broker) publish(s *stream, msg *Message) (*Message, bool) {
+	ctx, span := tracer().Start(MessageContext(context.Background(), msg), "publish "+msg.Stream,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("rustle.stream", msg.Stream)))
+	defer span.End()
+
+	if msg.IdempotencyKey != "" {
+		if original := s.dedup.lookup(msg.IdempotencyKey); original != nil {
+			span.SetAttributes(attribute.String("rustle.message_id", original.Id), attribute.Bool("rustle.duplicate", true))
+			return original, true
+		}
+		s.dedup.add(msg.IdempotencyKey, msg)
+	}
+
+	span.SetAttributes(attribute.String("rustle.message_id", msg.Id))
+	InjectContext(ctx, msg)
+
+	if msg.DeliverAt > uint64(time.Now().UnixNano()) {
+		msg.delayed = true
+		b.schedule(s, msg)
+	} else {
+		b.appendMessage(s, msg)
+	}
+	return msg, false
+}
+
+// retention returns the time after which messages of the stream are discarded, or zero if they are kept forever.
+func (b *Broker) retention(s *stream) time.Duration {
+	if s.opts.Retention > 0 {
+		return time.Duration(s.opts.Retention)
+	}
+	return b.opts.DefaultRetention
+}
+
+func (b *Broker) appendMessage(s *stream, msg *Message) {
+	// published messages are charged when admitted, while the ones generated by the broker (such as dead letters) are charged here
+	if msg.size == 0 {
+		msg.size = msg.Size()
+		b.opts.Memory.add(msg.size)
+	}
 	s.addMessage(msg)
+	s.lastActive = msg.storedAt
 
 	for _, group := range b.cGroups {
-		group.notify(msg)
+		group.notify(s, msg)
+	}
+
+	if msg.ExpiresAt != 0 {
+		b.timers.schedule(int64(msg.ExpiresAt), func() {
+			b.expire(s, msg)
+		})
+	}
+
+	if s.trimAt == 0 && b.retention(s) > 0 {
+		b.scheduleTrim(s, msg.storedAt)
+	}
+}
+
+// scheduleTrim schedules the trim of a stream for when the message stored at the given instant falls out of retention.
+// A small delay is added, so that messages stored close in time are trimmed together.
+func (b *Broker) scheduleTrim(s *stream, storedAt int64) {
+	retention := b.retention(s)
+	s.trimAt = storedAt + int64(retention+retention/trimSlack)
+
+	b.timers.schedule(s.trimAt, func() {
+		b.trim(s)
+	})
+}
+
+// trimSlack is the fraction of the retention which messages can outlive, in order to batch trims.
+const trimSlack = 100
+
+// trim removes the messages at the head of the stream which have been stored for longer than its retention,
+// and schedules the next trim. Messages having a TTL are skipped, since they are discarded when they expire.
+func (b *Broker) trim(s *stream) {
+	s.trimAt = 0
+	if len(s.msgs) == 0 || b.streams[s.msgs[0].Stream] != s {
+		return
+	}
+
+	cutoff := time.Now().UnixNano() - int64(b.retention(s))
+	for seq := s.base; seq < s.nextSeq(); seq++ {
+		msg := s.msgs[seq-s.base]
+		if msg == nil {
+			continue
+		}
+
+		if msg.storedAt > cutoff {
+			b.scheduleTrim(s, msg.storedAt)
+			return
+		}
+
+		if msg.ExpiresAt == 0 {
+			b.removeMessage(s, msg)
+			if seq < s.base {
+				// the head has moved past the following empty slots
+				seq = s.base - 1
+			}
+		}
+	}
+}
+
+// ExpiryNotice is the data of the message appended to the expiry stream
+// of a stream for each message which expired before being acked by some group.
+type ExpiryNotice struct {
+	Message *Message `json:"message"`
+	Groups  []string `json:"groups"`
+}
+
+// expire reclaims an expired message, removing it from its stream as well as
+// from the pending list of all the groups.
+func (b *Broker) expire(s *stream, msg *Message) {
+	if b.streams[msg.Stream] != s || !s.contains(msg) {
+		return
+	}
+	groups := b.removeMessage(s, msg)
+
+	expiryStream, ok := b.streams[s.opts.ExpiryStream]
+	if len(groups) > 0 && ok {
+		notice := NewMessage(s.opts.ExpiryStream, toJsonValue(&ExpiryNotice{Message: msg, Groups: groups}))
+		notice.Key = msg.Key
+		b.appendMessage(expiryStream, notice)
+	}
+}
+
+// removeMessage removes a message from its stream, as well as from the pending list of all the groups.
+// It returns the names of the groups the message was pending for.
+func (b *Broker) removeMessage(s *stream, msg *Message) []string {
+	s.removeMessage(msg)
+
+	groups := make([]string, 0)
+	for name, group := range b.cGroups {
+		if group.discard(msg) {
+			groups = append(groups, name)
+		}
+	}
+	return groups
+}
+
+// DeleteMessages removes the messages with the given ids from a stream, so that they are
+// no longer returned by reads and are no longer pending for any group.
+// It returns the number of messages which have actually been deleted.
+func (b *Broker) DeleteMessages(sname string, ids []string) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.streams[sname]
+	if !ok {
+		return 0, fmt.Errorf("no such stream with name %s", sname)
+	}
+
+	n := 0
+	for _, id := range ids {
+		if msg := s.find(id); msg != nil {
+			b.removeMessage(s, msg)
+			n++
+		}
 	}
+	s.deleted += n
+	return n, nil
+}
+
+func (b *Broker) schedule(s *stream, msg *Message) {
+	s.scheduled++
+
+	b.timers.schedule(int64(msg.DeliverAt), func() {
+		s.scheduled--
+
+		// the stream could have been deleted in the meantime, in which case the message releases its memory
+		if b.streams[msg.Stream] == s {
+			b.appendMessage(s, msg)
+		} else {
+			b.opts.Memory.add(-msg.size)
+		}
+	})
 }
 
-func (b *Broker) CreateGroup(name string) bool {
+var ErrGroupExists = errors.New("consumer group already exists")
+
+// CreateGroup creates a new consumer group with the given options (defaults are used if opts is nil).
+// Groups which are not explicitly created are created with default options when the first consumer joins.
+// If a webhook is configured, the group gets a consumer pushing messages to it.
+func (b *Broker) CreateGroup(name string, opts *GroupOptions) error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
 	if _, ok := b.cGroups[name]; ok {
-		return false
+		return ErrGroupExists
+	}
+
+	if opts == nil {
+		opts = &GroupOptions{}
+	}
+	group := newConsumerGroup(name, *opts, b.opts.ConsumerBufferSize)
+
+	for sname, id := range opts.Streams {
+		s, ok := b.streams[sname]
+		if !ok {
+			return fmt.Errorf("no such stream with name %s", sname)
+		}
+
+		if err := group.bind(sname, s, id); err != nil {
+			return err
+		}
 	}
-	b.getOrCreateGroup(name)
-	return true
+
+	if opts.Webhook != nil {
+		if dlq := opts.Webhook.DeadLetterStream; dlq != "" && !b.hasStream(dlq) {
+			return fmt.Errorf("no such dead letter stream with name %s", dlq)
+		}
+
+		names, err := b.resolveStreams(opts.Webhook.Streams)
+		if err != nil {
+			return err
+		}
+
+		for _, sname := range names {
+			group.bind(sname, b.streams[sname], StartLatest)
+		}
+
+		c := group.addConsumerWithSubscriptions("webhook", names, opts.Webhook.Streams, nil)
+		c.webhook = true
+		c.wake = func() { b.resume(c) }
+		c.startWebhook(b, opts.Webhook.withDefaults())
+		group.catchUp(b.streams)
+	}
+
+	b.cGroups[name] = group
+	return nil
 }
 
-// TODO: do not allow to delete group if there are active consumers
-func (b *Broker) DeleteGroup(name string) {
+var ErrGroupHasConsumers = errors.New("consumer group has active consumers")
+
+// DeleteGroup deletes a consumer group, disconnecting all of its consumers.
+// Unless force is true, groups having connected consumers (other than webhooks) are not deleted.
+func (b *Broker) DeleteGroup(name string, force bool) error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
 	group, ok := b.cGroups[name]
 	if !ok {
-		return
+		return fmt.Errorf("no such group with name %s", name)
+	}
+
+	if !force && group.hasClients() {
+		return ErrGroupHasConsumers
 	}
 
 	delete(b.cGroups, name)
 
 	group.shutdown()
+	return nil
+}
+
+// Shutdown stops accepting new publishes and subscriptions, and waits for connected consumers to receive
+// the messages buffered for them. Consumers are then sent a terminal event (see ShutdownEvent) and disconnected.
+// If ctx expires first, the remaining consumers are stopped and the error of ctx is returned.
+// The state of the broker is not persisted, since persistence is not supported yet: streams and groups are
+// lost once the broker is discarded.
+func (b *Broker) Shutdown(ctx context.Context) error {
+	b.mu.Lock()
+	b.closing = true
+	b.opts.Memory.detach(b)
+
+	consumers := make([]*consumer, 0)
+	for _, group := range b.cGroups {
+		for _, c := range group.consumers {
+			c.drain()
+			consumers = append(consumers, c)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, c := range consumers {
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			for _, c := range consumers {
+				c.Stop()
+			}
+			return ctx.Err()
+		}
+	}
+	return nil
 }
 
 func (b *Broker) DeleteStream(sname string) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
+	b.removeStream(sname)
+}
+
+// removeStream deletes a stream, unbinding it from all the groups. Consumers subscribed to it
+// are attached again if a stream with the same name is created later.
+func (b *Broker) removeStream(sname string) {
+	if s, ok := b.streams[sname]; ok {
+		s.budget.add(-s.bytes)
+	}
 	delete(b.streams, sname)
+
+	for _, group := range b.cGroups {
+		delete(group.subscriptions, sname)
+	}
+}
+
+// ReadStream returns up to count messages of the stream (all of them, if count is zero)
+// satisfying the filter, starting right after the message with the given id.
+// If after is empty, messages are read from the beginning of the stream.
+func (b *Broker) ReadStream(sname string, after string, count int, filter *Filter) ([]*Message, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.streams[sname]
+	if !ok {
+		return nil, fmt.Errorf("no such stream with name %s", sname)
+	}
+	return s.read(after, count, filter), nil
+}
+
+// GetMessage returns the message with the given id, if it is stored inside the stream.
+func (b *Broker) GetMessage(sname string, id string) (*Message, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.streams[sname]
+	if !ok {
+		return nil, fmt.Errorf("no such stream with name %s", sname)
+	}
+
+	msg := s.find(id)
+	if msg == nil || msg.expired(time.Now().UnixNano()) {
+		return nil, fmt.Errorf("no such message with id %s in stream %s", id, sname)
+	}
+	return msg, nil
+}
+
+// ReadPartition returns up to count messages (all of them, if count is zero) of the given stream partition
+// satisfying the filter, starting from the given offset.
+func (b *Broker) ReadPartition(sname string, partition int, offset uint64, count int, filter *Filter) ([]*Message, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.streams[sname]
+	if !ok {
+		return nil, fmt.Errorf("no such stream with name %s", sname)
+	}
+
+	if partition < 0 || partition >= len(s.partitions) {
+		return nil, fmt.Errorf("no such partition %d in stream %s", partition, sname)
+	}
+	return s.readPartition(partition, offset, count, filter), nil
 }
 
 func (b *Broker) ListPending(sname string, cgroup string) ([]string, error) {
@@ -190,7 +1037,17 @@ func (b *Broker) ListPending(sname string, cgroup string) ([]string, error) {
 	return s.pendingMessages(), nil
 }
 
-func (b *Broker) AckMessages(cgroup string, ackMap map[string][]string) error {
+func (b *Broker) AckMessages(ctx context.Context, cgroup string, ackMap map[string][]string) error {
+	n := 0
+	for _, ids := range ackMap {
+		n += len(ids)
+	}
+
+	_, span := tracer().Start(ctx, "ack", trace.WithAttributes(
+		attribute.String("rustle.group", cgroup),
+		attribute.Int("rustle.messages", n)))
+	defer span.End()
+
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
@@ -199,11 +1056,6 @@ func (b *Broker) AckMessages(cgroup string, ackMap map[string][]string) error {
 		return fmt.Errorf("no such group with name %s", cgroup)
 	}
 
-	for stream, acks := range ackMap {
-		subscription := group.subscriptions[stream]
-		if subscription != nil {
-			subscription.ackMessages(acks)
-		}
-	}
+	group.ack(ackMap)
 	return nil
 }
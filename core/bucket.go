@@ -0,0 +1,64 @@
+package core
+
+import (
+	"math"
+	"time"
+)
+
+// TokenBucket limits the rate of events to rate per second, allowing bursts of up to burst events.
+// Instants are expressed in unix nanoseconds. It is not safe for concurrent use.
+type TokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	// last is the instant at which tokens have been last refilled
+	last int64
+}
+
+func NewTokenBucket(rate float64, burst float64, now int64) *TokenBucket {
+	return &TokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   now,
+	}
+}
+
+func (tb *TokenBucket) refill(now int64) {
+	if now > tb.last {
+		tb.tokens = math.Min(tb.burst, tb.tokens+tb.rate*float64(now-tb.last)/float64(time.Second))
+		tb.last = now
+	}
+}
+
+// Wait returns the time to wait before n tokens are available, which is zero if they already are.
+// Requests larger than the burst are allowed when the bucket is full, leaving it in debt.
+func (tb *TokenBucket) Wait(now int64, n float64) time.Duration {
+	tb.refill(now)
+
+	needed := math.Min(n, tb.burst)
+	if tb.tokens >= needed {
+		return 0
+	}
+	return time.Duration(math.Ceil((needed - tb.tokens) / tb.rate * float64(time.Second)))
+}
+
+// Full reports whether the bucket has refilled completely, so that it behaves as a new one.
+func (tb *TokenBucket) Full(now int64) bool {
+	tb.refill(now)
+	return tb.tokens >= tb.burst
+}
+
+// Refund gives back n tokens previously taken, for events which didn't happen in the end.
+func (tb *TokenBucket) Refund(n float64) {
+	tb.tokens = math.Min(tb.burst, tb.tokens+n)
+}
+
+// Take consumes n tokens, if available. Otherwise, it returns the time to wait before they are.
+func (tb *TokenBucket) Take(now int64, n float64) (bool, time.Duration) {
+	if wait := tb.Wait(now, n); wait > 0 {
+		return false, wait
+	}
+	tb.tokens -= n
+	return true, 0
+}
@@ -1,17 +1,54 @@
 package core
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// StartLatest is the start id making a group receive only the messages appended after it is bound to a stream
+	StartLatest = "$"
+	// StartEarliest is the start id making a group receive all the messages stored inside a stream
+	StartEarliest = "0"
 )
 
+var ErrInvalidStartId = errors.New("invalid start id")
+
+// ShutdownEvent is the last line sent to consumers when the broker shuts down,
+// telling them to reconnect to another instance.
+const ShutdownEvent = "event: shutdown"
+
 type consumer struct {
 	group string
 	id    uint64
-	outCh chan *Message
-	quit  chan struct{}
-	wg    sync.WaitGroup
+	name  string
+	// patterns holds the names (or glob patterns) of the streams the consumer is subscribed to
+	patterns []string
+	filter   *Filter
+	webhook  bool
+	outCh    chan *Message
+	quit     chan struct{}
+	// draining is closed when the broker shuts down, making the consumer flush its buffer and exit
+	draining chan struct{}
+	// done is closed once the delivery loop exits
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	// stalled is set when a message could not be sent because the buffer was full.
+	// The consumer then calls wake once it has freed some space, so that delivery is resumed.
+	stalled int32
+	wake    func()
 }
 
 func (c *consumer) start(w io.Writer) {
@@ -19,6 +56,7 @@ func (c *consumer) start(w io.Writer) {
 
 	go func() {
 		defer func() {
+			close(c.done)
 			c.wg.Done()
 		}()
 
@@ -26,14 +64,12 @@ func (c *consumer) start(w io.Writer) {
 			select {
 			case <-c.quit:
 				return
+			case <-c.draining:
+				c.flush(w)
+				return
 			case msg := <-c.outCh:
-				data, err := json.Marshal(msg)
-				if err != nil {
-					return
-				}
-
-				_, err = w.Write([]byte(string(data) + "\n"))
-				if err != nil {
+				c.freed()
+				if c.write(w, msg) != nil {
 					return
 				}
 			}
@@ -41,14 +77,111 @@ func (c *consumer) start(w io.Writer) {
 	}()
 }
 
-func (c *consumer) send(msg *Message) {
-	c.outCh <- msg
+// write sends a message to the consumer, unless it expired while waiting in the buffer.
+func (c *consumer) write(w io.Writer, msg *Message) error {
+	if msg.expired(time.Now().UnixNano()) {
+		return nil
+	}
+
+	span := c.startDelivery(msg)
+	defer span.End()
+
+	data, err := json.Marshal(msg)
+	if err == nil {
+		_, err = w.Write([]byte(string(data) + "\n"))
+	}
+
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+// startDelivery starts the span tracing the delivery of a message to the consumer, which is a child of
+// the span of its publish. The span must be ended once the message has been written to the consumer.
+func (c *consumer) startDelivery(msg *Message) trace.Span {
+	_, span := tracer().Start(MessageContext(context.Background(), msg), "deliver "+msg.Stream,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("rustle.stream", msg.Stream),
+			attribute.String("rustle.message_id", msg.Id),
+			attribute.String("rustle.group", c.group),
+			attribute.String("rustle.consumer", c.name)))
+	return span
+}
+
+// flush writes all the messages left inside the buffer, followed by the shutdown event.
+func (c *consumer) flush(w io.Writer) {
+	for {
+		select {
+		case msg := <-c.outCh:
+			c.freed()
+			if c.write(w, msg) != nil {
+				return
+			}
+		default:
+			w.Write([]byte(ShutdownEvent + "\n"))
+			return
+		}
+	}
+}
+
+func (c *consumer) matches(sname string) bool {
+	for _, pattern := range c.patterns {
+		if matchPattern(pattern, sname) {
+			return true
+		}
+	}
+	return false
+}
+
+// full reports whether the buffer of the consumer is full.
+func (c *consumer) full() bool {
+	return len(c.outCh) == cap(c.outCh)
+}
+
+// trySend enqueues a message without blocking, reporting whether there was room for it inside the buffer.
+// If not, the consumer is marked as stalled, so that it wakes the broker up once it frees some space.
+func (c *consumer) trySend(msg *Message) bool {
+	select {
+	case c.outCh <- msg:
+		return true
+	default:
+	}
+
+	atomic.StoreInt32(&c.stalled, 1)
+
+	// the buffer could have been drained before the consumer was marked
+	select {
+	case c.outCh <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// freed is called each time a message is taken from the buffer. If the consumer is stalled, it wakes the broker
+// up once half of the buffer is free, so that messages are then sent in batches rather than one by one.
+func (c *consumer) freed() {
+	if atomic.LoadInt32(&c.stalled) == 1 && len(c.outCh) <= cap(c.outCh)/2 && atomic.CompareAndSwapInt32(&c.stalled, 1, 0) {
+		c.wake()
+	}
 }
 
 func (c *consumer) Join() {
 	c.wg.Wait()
 }
 
+// drain makes the consumer exit once all the buffered messages have been delivered.
+// It must be called while holding the broker lock.
+func (c *consumer) drain() {
+	select {
+	case <-c.draining:
+	default:
+		close(c.draining)
+	}
+}
+
 func (c *consumer) Stop() {
 	select {
 	case c.quit <- struct{}{}:
@@ -56,10 +189,65 @@ func (c *consumer) Stop() {
 	}
 }
 
+// dispatchKey identifies a sequence of messages whose order must be preserved
+// by delivering them to a single consumer: either the messages having the same key,
+// or all the messages of a partition.
+type dispatchKey struct {
+	key       string
+	partition int
+}
+
+type pendingEntry struct {
+	owner *keyOwner
+	// deliveredAt is the instant (in unix nanoseconds) at which the message has been delivered
+	deliveredAt int64
+}
+
+// keyOwner tracks the consumer a dispatch key is currently bound to, along with
+// the number of messages with that key which have been delivered to it but not acked yet.
+type keyOwner struct {
+	dk       dispatchKey
+	c        *consumer
+	inFlight int
+}
+
 type streamSubscription struct {
 	consumers    []*consumer
-	pending      map[string]struct{}
+	pending      map[string]*pendingEntry
 	nextConsumer int
+
+	// cursor is the sequence number of the next message of the stream to be delivered to the group,
+	// and lastDelivered is the id of the last message the cursor has moved past.
+	cursor        uint64
+	lastDelivered string
+	// lag is the number of messages of the stream following the cursor. It is updated as messages
+	// are appended, delivered and removed, rather than being computed on each request.
+	lag int
+
+	delivered   meter
+	acked       meter
+	redelivered uint64
+	nacked      uint64
+
+	// ackless is set for the subscriptions of plain subscribers, which don't track pending messages since they never ack them
+	ackless bool
+
+	keyAffinity bool
+	ring        *hashRing
+	// sorted holds the consumers ordered by id, and it is used to assign partitions
+	sorted    []*consumer
+	keyOwners map[dispatchKey]*keyOwner
+}
+
+func newStreamSubscription(keyAffinity bool) *streamSubscription {
+	return &streamSubscription{
+		nextConsumer: 0,
+		consumers:    make([]*consumer, 0),
+		pending:      make(map[string]*pendingEntry),
+		keyAffinity:  keyAffinity,
+		ring:         newHashRing(nil),
+		keyOwners:    make(map[dispatchKey]*keyOwner),
+	}
 }
 
 func (s *streamSubscription) pendingMessages() []string {
@@ -70,8 +258,20 @@ func (s *streamSubscription) pendingMessages() []string {
 	return pending
 }
 
+func (s *streamSubscription) consumersChanged() {
+	if s.keyAffinity {
+		s.ring = newHashRing(s.consumers)
+	}
+
+	s.sorted = append(s.sorted[:0], s.consumers...)
+	sort.Slice(s.sorted, func(i, j int) bool {
+		return s.sorted[i].id < s.sorted[j].id
+	})
+}
+
 func (s *streamSubscription) add(c *consumer) {
 	s.consumers = append(s.consumers, c)
+	s.consumersChanged()
 }
 
 func (s *streamSubscription) remove(id uint64) {
@@ -81,42 +281,248 @@ func (s *streamSubscription) remove(id uint64) {
 			s.consumers[0] = s.consumers[i]
 			s.consumers[i] = temp
 			s.consumers = s.consumers[1:]
-			return
+			break
+		}
+	}
+	s.consumersChanged()
+
+	// keys bound to the removed consumer are reassigned on their next message
+	for dk, owner := range s.keyOwners {
+		if owner.c.id == id {
+			delete(s.keyOwners, dk)
 		}
 	}
 }
 
-func (l *streamSubscription) next() int {
-	next := l.nextConsumer % len(l.consumers)
-	l.nextConsumer++
-	return next
+// next returns the index of the next consumer, in round-robin order, whose filter accepts the message,
+// or -1 if no such consumer exists. Consumers whose buffer is full are skipped, unless all of them are full.
+func (l *streamSubscription) next(msg *Message) int {
+	first := -1
+	for i := 0; i < len(l.consumers); i++ {
+		next := (l.nextConsumer + i) % len(l.consumers)
+		if !l.consumers[next].filter.Match(msg) {
+			continue
+		}
+
+		if !l.consumers[next].full() {
+			l.nextConsumer = next + 1
+			return next
+		}
+
+		if first < 0 {
+			first = next
+		}
+	}
+	return first
+}
+
+// nextByKey returns the consumer a message should be dispatched to, according to its dispatch key.
+// A key stays bound to the same consumer as long as it has in-flight messages, so that
+// ordering is preserved even if the assignment changes because of a consumer joining the group.
+// Once all the in-flight messages are acked, the key moves to the consumer chosen by assign.
+func (l *streamSubscription) nextByKey(msg *Message, dk dispatchKey, assign func() *consumer) *consumer {
+	if owner, ok := l.keyOwners[dk]; ok {
+		if owner.c.filter.Match(msg) {
+			return owner.c
+		}
+		return nil
+	}
+
+	if c := assign(); c != nil && c.filter.Match(msg) {
+		return c
+	}
+	return nil
 }
 
-func (l *streamSubscription) send(msg *Message) {
-	l.pending[msg.Id] = struct{}{}
+// dispatch returns the consumer a message should be delivered to, along with its dispatch key, if any.
+// It returns a nil consumer if the message is filtered out by all the consumers.
+func (l *streamSubscription) dispatch(msg *Message, partitioned bool) (*consumer, *dispatchKey) {
+	var dk dispatchKey
+	var assign func() *consumer
 
-	if len(l.consumers) > 0 {
-		c := l.consumers[l.next()]
-		c.send(msg)
+	switch {
+	case partitioned:
+		// each partition is consumed by exactly one consumer of the group
+		dk = dispatchKey{partition: msg.Partition}
+		assign = func() *consumer {
+			return l.sorted[msg.Partition%len(l.sorted)]
+		}
+	case l.keyAffinity && msg.Key != "":
+		dk = dispatchKey{key: msg.Key, partition: -1}
+		assign = func() *consumer {
+			return l.ring.lookup(msg.Key, func(c *consumer) bool {
+				return c.filter.Match(msg)
+			})
+		}
+	default:
+		if next := l.next(msg); next >= 0 {
+			return l.consumers[next], nil
+		}
+		return nil, nil
 	}
+	return l.nextByKey(msg, dk, assign), &dk
 }
 
-func (s *streamSubscription) ackMessages(ids []string) {
+// catchUp delivers the messages of the stream following the cursor. Messages are held while the group
+// has no consumers, and they are delivered as soon as the first one joins. Delivery stops at the first
+// message dispatched to a consumer whose buffer is full, and it is resumed once the consumer frees some
+// space (see Broker.resume), so that the broker lock is never held while waiting for consumers.
+func (l *streamSubscription) catchUp(s *stream) {
+	if len(l.consumers) == 0 {
+		return
+	}
+
+	if l.cursor < s.base {
+		l.cursor = s.base
+	}
+
+	for ; l.cursor < s.nextSeq(); l.cursor++ {
+		if msg := s.msgs[l.cursor-s.base]; msg != nil {
+			if !l.send(msg, s.partitioned()) {
+				return
+			}
+			l.lastDelivered = msg.Id
+			l.lag--
+		}
+	}
+}
+
+// send delivers a message to one of the consumers, reporting false if it has been dispatched
+// to a consumer whose buffer is full, in which case the message must be sent again later.
+func (l *streamSubscription) send(msg *Message, partitioned bool) bool {
+	if msg.expired(time.Now().UnixNano()) {
+		return true
+	}
+
+	c, dk := l.dispatch(msg, partitioned)
+
+	// messages filtered out by all the consumers are not tracked as pending
+	if c == nil {
+		return true
+	}
+
+	if !c.trySend(msg) {
+		return false
+	}
+
+	now := time.Now().UnixNano()
+	l.delivered.mark(now, 1)
+
+	// a message which is still pending is delivered again if the cursor is moved back
+	if _, ok := l.pending[msg.Id]; ok {
+		l.ackMessages([]string{msg.Id})
+		l.redelivered++
+	}
+
+	var owner *keyOwner
+	if dk != nil {
+		owner = l.keyOwners[*dk]
+		if owner == nil {
+			owner = &keyOwner{dk: *dk, c: c}
+			l.keyOwners[*dk] = owner
+		}
+		owner.inFlight++
+	}
+
+	if !l.ackless {
+		l.pending[msg.Id] = &pendingEntry{owner: owner, deliveredAt: now}
+	}
+	return true
+}
+
+// ackMessages removes the given messages from the pending list, returning the number of messages which were pending.
+func (s *streamSubscription) ackMessages(ids []string) int {
+	n := 0
 	for _, id := range ids {
+		entry, ok := s.pending[id]
+		if !ok {
+			continue
+		}
 		delete(s.pending, id)
+		n++
+
+		if owner := entry.owner; owner != nil {
+			owner.inFlight--
+			if owner.inFlight <= 0 && s.keyOwners[owner.dk] == owner {
+				delete(s.keyOwners, owner.dk)
+			}
+		}
+	}
+	return n
+}
+
+// consumed reports whether a message of the stream has been delivered to the group and acked.
+func (s *streamSubscription) consumed(msg *Message) bool {
+	_, pending := s.pending[msg.Id]
+	return msg.seq < s.cursor && !pending
+}
+
+// countLag computes the lag from scratch, which is only needed when the cursor is moved.
+func (s *streamSubscription) countLag(stream *stream) {
+	start := s.cursor
+	if start < stream.base {
+		start = stream.base
+	}
+
+	s.lag = 0
+	for seq := start; seq < stream.nextSeq(); seq++ {
+		if stream.msgs[seq-stream.base] != nil {
+			s.lag++
+		}
+	}
+}
+
+// oldestPending returns the instant at which the oldest pending message has been delivered, or zero if none is pending.
+func (s *streamSubscription) oldestPending() int64 {
+	oldest := int64(0)
+	for _, entry := range s.pending {
+		if oldest == 0 || entry.deliveredAt < oldest {
+			oldest = entry.deliveredAt
+		}
+	}
+	return oldest
+}
+
+type GroupOptions struct {
+	// KeyAffinity enables key based dispatching: messages having the same key are always
+	// delivered to the same consumer, in order, instead of being spread in round-robin.
+	// Messages without a key are still dispatched in round-robin.
+	KeyAffinity bool `json:"keyAffinity"`
+	// Webhook, if set, makes the broker push messages of the group to an http endpoint
+	Webhook *WebhookOptions `json:"webhook,omitempty"`
+	// Streams binds the group to the given streams, mapping each of them to the id of the message after which
+	// delivery starts (StartLatest, if empty). Streams which are not bound explicitly are bound on the
+	// first subscription of a consumer, starting from the latest message.
+	Streams map[string]string `json:"streams,omitempty"`
+}
+
+func (opts *GroupOptions) Validate() error {
+	for sname := range opts.Streams {
+		if IsPattern(sname) {
+			return ErrInvalidPattern
+		}
+	}
+
+	if opts.Webhook != nil {
+		return opts.Webhook.Validate()
 	}
+	return nil
 }
 
 type consumerGroup struct {
 	nextConsumerId uint64
 	name           string
+	opts           GroupOptions
+	bufferSize     int
 	consumers      map[uint64]*consumer
 	subscriptions  map[string]*streamSubscription
 }
 
-func newConsumerGroup(name string) *consumerGroup {
+func newConsumerGroup(name string, opts GroupOptions, bufferSize int) *consumerGroup {
 	return &consumerGroup{
 		name:          name,
+		opts:          opts,
+		bufferSize:    bufferSize,
 		consumers:     make(map[uint64]*consumer),
 		subscriptions: make(map[string]*streamSubscription),
 	}
@@ -124,21 +530,80 @@ func newConsumerGroup(name string) *consumerGroup {
 
 func (group *consumerGroup) getOrCreateSubscription(sname string) *streamSubscription {
 	if _, ok := group.subscriptions[sname]; !ok {
-		group.subscriptions[sname] = &streamSubscription{
-			nextConsumer: 0,
-			consumers:    make([]*consumer, 0),
-			pending:      make(map[string]struct{}),
-		}
+		subscription := newStreamSubscription(group.opts.KeyAffinity)
+		subscription.ackless = group.plain()
+		group.subscriptions[sname] = subscription
 	}
 	return group.subscriptions[sname]
 }
 
-func (group *consumerGroup) addConsumerWithSubscriptions(streams []string) *consumer {
+// plain reports whether the group is the implicit one of the consumers subscribing without a group.
+// Plain subscribers only receive the messages appended while they are connected, and they never ack them.
+func (group *consumerGroup) plain() bool {
+	return group.name == ""
+}
+
+// bind starts tracking the stream inside the group, from the given start id, unless it is already tracked.
+func (group *consumerGroup) bind(sname string, s *stream, id string) error {
+	if _, ok := group.subscriptions[sname]; ok {
+		return nil
+	}
+	return group.setCursor(sname, s, id)
+}
+
+// setCursor moves the cursor of the group on the stream right after the message with the given id,
+// and delivers the messages following it.
+func (group *consumerGroup) setCursor(sname string, s *stream, id string) error {
+	cursor, lastDelivered, err := s.position(id)
+	if err != nil {
+		return err
+	}
+
+	subscription := group.getOrCreateSubscription(sname)
+	subscription.cursor = cursor
+	subscription.lastDelivered = lastDelivered
+	subscription.countLag(s)
+	subscription.catchUp(s)
+	return nil
+}
+
+func (group *consumerGroup) getConsumer(name string) *consumer {
+	for _, c := range group.consumers {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// hasClients reports whether some consumer, other than the ones pushing to webhooks, is connected to the group.
+func (group *consumerGroup) hasClients() bool {
+	for _, c := range group.consumers {
+		if !c.webhook {
+			return true
+		}
+	}
+	return false
+}
+
+// addConsumerWithSubscriptions adds a consumer to the group, subscribing it to the given streams.
+// The consumer is also subscribed to streams created later whose name matches one of patterns.
+// If name is empty, the consumer is named after its id.
+func (group *consumerGroup) addConsumerWithSubscriptions(name string, streams []string, patterns []string, filter *Filter) *consumer {
+	if name == "" {
+		name = "consumer-" + strconv.FormatUint(group.nextConsumerId, 10)
+	}
+
 	c := &consumer{
-		group: group.name,
-		id:    group.nextConsumerId,
-		outCh: make(chan *Message, 1024),
-		quit:  make(chan struct{}, 1),
+		group:    group.name,
+		id:       group.nextConsumerId,
+		name:     name,
+		patterns: patterns,
+		filter:   filter,
+		outCh:    make(chan *Message, group.bufferSize),
+		quit:     make(chan struct{}, 1),
+		draining: make(chan struct{}),
+		done:     make(chan struct{}),
 	}
 	group.consumers[group.nextConsumerId] = c
 	group.nextConsumerId++
@@ -150,20 +615,73 @@ func (group *consumerGroup) addConsumerWithSubscriptions(streams []string) *cons
 	return c
 }
 
+// catchUp delivers to the consumers of the group the messages following the cursor of each stream.
+func (group *consumerGroup) catchUp(streams map[string]*stream) {
+	for sname, subscription := range group.subscriptions {
+		if s, ok := streams[sname]; ok {
+			subscription.catchUp(s)
+		}
+	}
+}
+
+// attachStream subscribes to a newly created stream all the consumers
+// having at least one pattern matching its name.
+func (group *consumerGroup) attachStream(sname string) {
+	for _, c := range group.consumers {
+		if c.matches(sname) {
+			group.getOrCreateSubscription(sname).add(c)
+		}
+	}
+}
+
+// removeConsumer detaches a consumer from the group. Subscriptions are kept, so that
+// the messages appended in the meantime are delivered to the next consumer joining the group.
+// Subscriptions of plain subscribers are instead dropped once they have no consumers, so that
+// the next plain subscriber starts again from the latest message.
 func (group *consumerGroup) removeConsumer(c *consumer) {
 	delete(group.consumers, c.id)
 
 	for sname, subscription := range group.subscriptions {
 		subscription.remove(c.id)
-
-		if len(subscription.consumers) == 0 && len(subscription.pending) == 0 {
+		if group.plain() && len(subscription.consumers) == 0 {
 			delete(group.subscriptions, sname)
 		}
 	}
 }
 
-func (group *consumerGroup) notify(msg *Message) {
-	group.getOrCreateSubscription(msg.Stream).send(msg)
+func (group *consumerGroup) notify(s *stream, msg *Message) {
+	if subscription := group.subscriptions[msg.Stream]; subscription != nil {
+		subscription.lag++
+		subscription.catchUp(s)
+	}
+}
+
+func (group *consumerGroup) ack(ackMap map[string][]string) {
+	for stream, acks := range ackMap {
+		subscription := group.subscriptions[stream]
+		if subscription != nil {
+			n := subscription.ackMessages(acks)
+			subscription.acked.mark(time.Now().UnixNano(), n)
+		}
+	}
+}
+
+// discard forgets a message which has been removed from its stream, reporting whether it was pending for the group.
+func (group *consumerGroup) discard(msg *Message) bool {
+	subscription := group.subscriptions[msg.Stream]
+	if subscription == nil {
+		return false
+	}
+
+	if msg.seq >= subscription.cursor {
+		subscription.lag--
+	}
+
+	if _, ok := subscription.pending[msg.Id]; !ok {
+		return false
+	}
+	subscription.ackMessages([]string{msg.Id})
+	return true
 }
 
 func (group *consumerGroup) shutdown() {
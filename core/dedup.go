@@ -0,0 +1,67 @@
+package core
+
+import "time"
+
+const (
+	defaultDedupWindow  = 2 * time.Minute
+	defaultDedupMaxKeys = 10000
+)
+
+type dedupEntry struct {
+	key string
+	msg *Message
+	at  int64
+}
+
+// dedupWindow remembers the messages published with an idempotency key, so that retries
+// can be detected. Keys are forgotten once they are older than the window duration,
+// or when more than maxKeys keys are being tracked.
+type dedupWindow struct {
+	window  time.Duration
+	maxKeys int
+	entries map[string]*dedupEntry
+	// order holds the entries sorted by insertion time
+	order []*dedupEntry
+}
+
+func newDedupWindow(window time.Duration, maxKeys int) *dedupWindow {
+	if window == 0 {
+		window = defaultDedupWindow
+	}
+	if maxKeys == 0 {
+		maxKeys = defaultDedupMaxKeys
+	}
+
+	return &dedupWindow{
+		window:  window,
+		maxKeys: maxKeys,
+		entries: make(map[string]*dedupEntry),
+		order:   make([]*dedupEntry, 0),
+	}
+}
+
+func (w *dedupWindow) evict(now int64) {
+	for len(w.order) > 0 && (len(w.order) > w.maxKeys || w.order[0].at+int64(w.window) <= now) {
+		delete(w.entries, w.order[0].key)
+		w.order[0] = nil
+		w.order = w.order[1:]
+	}
+}
+
+// lookup returns the message previously published with the given key, if any.
+func (w *dedupWindow) lookup(key string) *Message {
+	w.evict(time.Now().UnixNano())
+
+	if entry, ok := w.entries[key]; ok {
+		return entry.msg
+	}
+	return nil
+}
+
+func (w *dedupWindow) add(key string, msg *Message) {
+	entry := &dedupEntry{key: key, msg: msg, at: time.Now().UnixNano()}
+	w.entries[key] = entry
+	w.order = append(w.order, entry)
+
+	w.evict(entry.at)
+}
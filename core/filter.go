@@ -0,0 +1,203 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidFilter = errors.New("invalid filter expression")
+
+const (
+	OpEq     = "eq"
+	OpNe     = "ne"
+	OpGt     = "gt"
+	OpGte    = "gte"
+	OpLt     = "lt"
+	OpLte    = "lte"
+	OpExists = "exists"
+)
+
+// Filter is a predicate evaluated against a message.
+// A leaf filter compares the value found at Path (a dot separated list of object keys
+// or array indexes, e.g. "customer.address.country") with Value, according to Op.
+// Paths are relative to the message data, except for the special paths "$key", "$stream"
+// and "$headers.<name>", which refer to the message key, stream and headers, respectively
+// (header names are case insensitive).
+// Non-leaf filters combine their children through And/Or.
+//
+// Example: {"and": [{"path": "amount", "op": "gte", "value": 10}, {"path": "country", "op": "eq", "value": "IT"}]}
+type Filter struct {
+	And   []*Filter   `json:"and,omitempty"`
+	Or    []*Filter   `json:"or,omitempty"`
+	Path  string      `json:"path,omitempty"`
+	Op    string      `json:"op,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// ParseFilter decodes a json filter expression, checking that it is well formed.
+func ParseFilter(expr string) (*Filter, error) {
+	f := &Filter{}
+	if err := json.Unmarshal([]byte(expr), f); err != nil {
+		return nil, ErrInvalidFilter
+	}
+
+	if err := f.validate(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *Filter) validate() error {
+	isLeaf := f.Op != ""
+	if isLeaf == (len(f.And) > 0 || len(f.Or) > 0) || (len(f.And) > 0 && len(f.Or) > 0) {
+		return ErrInvalidFilter
+	}
+
+	for _, child := range append(f.And, f.Or...) {
+		if child == nil {
+			return ErrInvalidFilter
+		}
+		if err := child.validate(); err != nil {
+			return err
+		}
+	}
+
+	switch f.Op {
+	case "", OpEq, OpNe:
+	case OpGt, OpGte, OpLt, OpLte:
+		if _, isNum := f.Value.(float64); !isNum {
+			if _, isString := f.Value.(string); !isString {
+				return ErrInvalidFilter
+			}
+		}
+	case OpExists:
+		if _, isBool := f.Value.(bool); f.Value != nil && !isBool {
+			return ErrInvalidFilter
+		}
+	default:
+		return ErrInvalidFilter
+	}
+	return nil
+}
+
+// Match reports whether the message satisfies the filter. A nil filter matches every message.
+func (f *Filter) Match(msg *Message) bool {
+	if f == nil {
+		return true
+	}
+
+	if len(f.And) > 0 {
+		for _, child := range f.And {
+			if !child.Match(msg) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if len(f.Or) > 0 {
+		for _, child := range f.Or {
+			if child.Match(msg) {
+				return true
+			}
+		}
+		return false
+	}
+
+	v, found := lookupField(msg, f.Path)
+	if f.Op == OpExists {
+		exists, ok := f.Value.(bool)
+		return found == (exists || !ok)
+	}
+
+	if !found {
+		return false
+	}
+	return compareValues(f.Op, v, f.Value)
+}
+
+func lookupField(msg *Message, path string) (interface{}, bool) {
+	switch {
+	case path == "$key":
+		return msg.Key, msg.Key != ""
+	case path == "$stream":
+		return msg.Stream, true
+	case strings.HasPrefix(path, "$headers."):
+		v, ok := msg.Headers[strings.ToLower(strings.TrimPrefix(path, "$headers."))]
+		return v, ok
+	}
+	return lookupPath(msg.Data, path)
+}
+
+func lookupPath(data interface{}, path string) (interface{}, bool) {
+	if path == "" {
+		return data, true
+	}
+
+	v := data
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			child, ok := node[key]
+			if !ok {
+				return nil, false
+			}
+			v = child
+		case []interface{}:
+			idx, err := strconv.Atoi(key)
+			if err != nil || idx < 0 || idx >= len(node) {
+				return nil, false
+			}
+			v = node[idx]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func compareValues(op string, x, y interface{}) bool {
+	switch op {
+	case OpEq:
+		return reflect.DeepEqual(x, y)
+	case OpNe:
+		return !reflect.DeepEqual(x, y)
+	}
+
+	var cmp int
+	switch a := x.(type) {
+	case float64:
+		b, ok := y.(float64)
+		if !ok {
+			return false
+		}
+		if a < b {
+			cmp = -1
+		} else if a > b {
+			cmp = 1
+		}
+	case string:
+		b, ok := y.(string)
+		if !ok {
+			return false
+		}
+		cmp = strings.Compare(a, b)
+	default:
+		return false
+	}
+
+	switch op {
+	case OpGt:
+		return cmp > 0
+	case OpGte:
+		return cmp >= 0
+	case OpLt:
+		return cmp < 0
+	case OpLte:
+		return cmp <= 0
+	}
+	return false
+}
@@ -0,0 +1,295 @@
+package core
+
+import (
+	"container/heap"
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// MemoryPolicy is the behavior of brokers when storing a message would exceed their memory budget.
+type MemoryPolicy string
+
+const (
+	// MemoryReject rejects publishes with ErrMemoryExhausted.
+	MemoryReject MemoryPolicy = "reject"
+	// MemoryEvict removes the oldest messages acked by all the groups subscribed to their stream, from all the brokers
+	// sharing the budget, and it rejects publishes only if not enough memory can be reclaimed. Only the acked head of
+	// each stream is evicted, while messages of streams without groups (other than plain subscribers, which never ack)
+	// can be evicted at any time. Messages larger than the whole budget are rejected without evicting anything.
+	MemoryEvict MemoryPolicy = "evict"
+)
+
+var (
+	ErrInvalidMemoryPolicy = errors.New("invalid memory policy")
+	ErrMemoryExhausted     = errors.New("memory budget exhausted")
+)
+
+func (p MemoryPolicy) Validate() error {
+	if p != MemoryReject && p != MemoryEvict {
+		return ErrInvalidMemoryPolicy
+	}
+	return nil
+}
+
+// MemoryBudget bounds the approximate size of the messages stored by one or more brokers
+// (for example, the brokers of all the namespaces of a server). It is safe for concurrent use.
+type MemoryBudget struct {
+	limit  int64
+	policy MemoryPolicy
+
+	used     int64
+	evicted  uint64
+	rejected uint64
+
+	// mu guards brokers, the set of brokers sharing the budget, and evictMu serializes evictions
+	mu      sync.Mutex
+	brokers map[*Broker]struct{}
+	evictMu sync.Mutex
+}
+
+// NewMemoryBudget creates a budget of limit bytes, which is shared by all the brokers it is supplied to.
+func NewMemoryBudget(limit int64, policy MemoryPolicy) *MemoryBudget {
+	return &MemoryBudget{limit: limit, policy: policy, brokers: make(map[*Broker]struct{})}
+}
+
+func (m *MemoryBudget) validate() error {
+	if m.limit <= 0 {
+		return ErrInvalidBrokerOptions
+	}
+	return m.policy.Validate()
+}
+
+// attach registers a broker sharing the budget, so that its messages can be evicted on behalf of the other ones.
+func (m *MemoryBudget) attach(b *Broker) {
+	if m != nil {
+		m.mu.Lock()
+		m.brokers[b] = struct{}{}
+		m.mu.Unlock()
+	}
+}
+
+func (m *MemoryBudget) detach(b *Broker) {
+	if m != nil {
+		m.mu.Lock()
+		delete(m.brokers, b)
+		m.mu.Unlock()
+	}
+}
+
+// add accounts for size bytes being stored, or released if size is negative. It is a no-op on a nil budget.
+func (m *MemoryBudget) add(size int) {
+	if m != nil {
+		atomic.AddInt64(&m.used, int64(size))
+	}
+}
+
+// reserve accounts for size bytes being stored, unless they would exceed the limit. It always succeeds on a nil budget.
+func (m *MemoryBudget) reserve(size int) bool {
+	if m == nil {
+		return true
+	}
+
+	for {
+		used := atomic.LoadInt64(&m.used)
+		if used+int64(size) > m.limit {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&m.used, used, used+int64(size)) {
+			return true
+		}
+	}
+}
+
+// available returns the number of bytes which can still be stored.
+func (m *MemoryBudget) available() int64 {
+	return m.limit - atomic.LoadInt64(&m.used)
+}
+
+// MemoryUsage reports the state of a memory budget.
+type MemoryUsage struct {
+	Limit  int64        `json:"limit"`
+	Used   int64        `json:"used"`
+	Policy MemoryPolicy `json:"policy"`
+	// Evicted is the total number of messages evicted to reclaim memory
+	Evicted uint64 `json:"evicted"`
+	// Rejected is the total number of publishes rejected because memory was exhausted
+	Rejected uint64 `json:"rejected"`
+}
+
+func (m *MemoryBudget) Usage() MemoryUsage {
+	return MemoryUsage{
+		Limit:    m.limit,
+		Used:     atomic.LoadInt64(&m.used),
+		Policy:   m.policy,
+		Evicted:  atomic.LoadUint64(&m.evicted),
+		Rejected: atomic.LoadUint64(&m.rejected),
+	}
+}
+
+// evictionBatch is the fraction of the budget which is reclaimed at least on each eviction,
+// so that eviction doesn't run on every publish once the budget is exhausted.
+const evictionBatch = 10
+
+// errMemoryShortage reports that the memory budget has no room for a publish, before eviction is attempted.
+var errMemoryShortage = errors.New("memory shortage")
+
+// evict makes room for size more bytes, removing the oldest acked messages of all the brokers sharing the budget.
+// Brokers are locked one at a time, so the caller must not hold the lock of any of them.
+func (m *MemoryBudget) evict(size int) {
+	m.evictMu.Lock()
+	defer m.evictMu.Unlock()
+
+	// a concurrent eviction could have already made room
+	excess := int64(size) - m.available()
+	if excess <= 0 {
+		return
+	}
+
+	n := excess + m.limit/evictionBatch
+	for reclaimed := int64(0); reclaimed < n; {
+		// messages are evicted from the broker holding the oldest one, until they get newer than the ones of the others
+		var oldest *Broker
+		first, next := int64(math.MaxInt64), int64(math.MaxInt64)
+		for _, b := range m.attached() {
+			at, ok := b.oldestEvictable()
+			switch {
+			case !ok:
+			case at < first:
+				oldest, first, next = b, at, first
+			case at < next:
+				next = at
+			}
+		}
+
+		if oldest == nil {
+			return
+		}
+
+		freed := oldest.evict(n-reclaimed, next)
+		if freed == 0 {
+			return
+		}
+		reclaimed += freed
+	}
+}
+
+func (m *MemoryBudget) attached() []*Broker {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	brokers := make([]*Broker, 0, len(m.brokers))
+	for b := range m.brokers {
+		brokers = append(brokers, b)
+	}
+	return brokers
+}
+
+// evictionQueue orders the streams whose head can be evicted by the instant at which the head has been stored.
+// The head of a stream can be evicted once it has been acked by all the groups subscribed to the stream, so
+// only the acked prefix of each stream is evicted. Subscriptions of plain subscribers are not taken into account,
+// since they never ack messages, so that streams without groups can be evicted from their oldest message.
+type evictionQueue []*evictionEntry
+
+type evictionEntry struct {
+	s             *stream
+	subscriptions []*streamSubscription
+}
+
+func (q evictionQueue) Len() int { return len(q) }
+
+func (q evictionQueue) Less(i, j int) bool {
+	return q[i].s.msgs[0].storedAt < q[j].s.msgs[0].storedAt
+}
+
+func (q evictionQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *evictionQueue) Push(x interface{}) { *q = append(*q, x.(*evictionEntry)) }
+
+func (q *evictionQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+// evictable reports whether the head of the stream has been acked by all the groups subscribed to it.
+// Only the subscriptions which ack messages are tracked by the entry.
+func (e *evictionEntry) evictable() bool {
+	if len(e.s.msgs) == 0 {
+		return false
+	}
+
+	for _, subscription := range e.subscriptions {
+		if !subscription.consumed(e.s.msgs[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+// evictionQueue returns the streams of the broker whose head can be evicted.
+func (b *Broker) evictionQueue() evictionQueue {
+	subscriptions := make(map[string][]*streamSubscription)
+	for _, group := range b.cGroups {
+		for name, subscription := range group.subscriptions {
+			if !subscription.ackless {
+				subscriptions[name] = append(subscriptions[name], subscription)
+			}
+		}
+	}
+
+	q := make(evictionQueue, 0, len(b.streams))
+	for name, s := range b.streams {
+		e := &evictionEntry{s: s, subscriptions: subscriptions[name]}
+		if e.evictable() {
+			q = append(q, e)
+		}
+	}
+	heap.Init(&q)
+	return q
+}
+
+// oldestEvictable returns the instant at which the oldest message which can be evicted has been stored, if any.
+func (b *Broker) oldestEvictable() (int64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	q := b.evictionQueue()
+	if len(q) == 0 {
+		return 0, false
+	}
+	return q[0].s.msgs[0].storedAt, true
+}
+
+// evict removes the oldest acked messages of the broker, until at least n bytes are reclaimed, no such message
+// is left, or the remaining ones have been stored after cutoff. It returns the number of reclaimed bytes.
+func (b *Broker) evict(n int64, cutoff int64) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	q := b.evictionQueue()
+
+	reclaimed := int64(0)
+	evicted := uint64(0)
+	for len(q) > 0 && reclaimed < n {
+		e := q[0]
+		msg := e.s.msgs[0]
+		if msg.storedAt > cutoff && reclaimed > 0 {
+			break
+		}
+
+		reclaimed += int64(msg.size)
+		b.removeMessage(e.s, msg)
+		evicted++
+
+		if e.evictable() {
+			heap.Fix(&q, 0)
+		} else {
+			heap.Pop(&q)
+		}
+	}
+	atomic.AddUint64(&b.opts.Memory.evicted, evicted)
+	return reclaimed
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"encoding/json"
 	"time"
 
 	uuid "github.com/satori/go.uuid"
@@ -8,9 +9,35 @@ import (
 
 type Message struct {
 	Id        string
-	Timestamp uint64      `json:"timestamp"`
-	Stream    string      `json:"stream"`
-	Data      interface{} `json:"data"`
+	Timestamp uint64 `json:"timestamp"`
+	Stream    string `json:"stream"`
+	// Partition and Offset locate the message inside the stream. They are assigned when the message is stored.
+	Partition int    `json:"partition"`
+	Offset    uint64 `json:"offset"`
+	// Key is an optional, user supplied identifier (e.g. an order id) used for routing messages.
+	Key string `json:"key,omitempty"`
+	// Headers hold metadata (e.g. trace ids, content type, tenant) which are kept separate from the payload.
+	Headers map[string]string `json:"headers,omitempty"`
+	// DeliverAt, if set, is the instant (in unix nanoseconds) at which the message becomes visible to consumers.
+	DeliverAt uint64 `json:"deliverAt,omitempty"`
+	// ExpiresAt, if set, is the instant (in unix nanoseconds) after which the message is no longer delivered.
+	ExpiresAt uint64 `json:"expiresAt,omitempty"`
+	// IdempotencyKey, if set, allows the broker to detect duplicate publishes of the same message.
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+	// ReplyTo and CorrelationId support request/reply messaging: a responder publishes its reply
+	// to the ReplyTo stream, copying the CorrelationId of the request.
+	ReplyTo       string      `json:"replyTo,omitempty"`
+	CorrelationId string      `json:"correlationId,omitempty"`
+	Data          interface{} `json:"data"`
+
+	// seq is the position of the message inside its stream
+	seq uint64
+	// size is the (approximate) number of bytes occupied by the message
+	size int
+	// storedAt is the instant (in unix nanoseconds) at which the message has been appended to its stream
+	storedAt int64
+	// delayed is set when the message is published, if it is held by the broker until DeliverAt
+	delayed bool
 }
 
 func NewMessage(stream string, data interface{}) *Message {
@@ -21,3 +48,42 @@ func NewMessage(stream string, data interface{}) *Message {
 		Data:      data,
 	}
 }
+
+func (msg *Message) expired(now int64) bool {
+	return msg.ExpiresAt != 0 && msg.ExpiresAt <= uint64(now)
+}
+
+// Delayed reports whether the message has been held by the broker when published, rather than being
+// stored right away. The Partition and Offset of delayed messages are only assigned once they are due.
+func (msg *Message) Delayed() bool {
+	return msg.delayed
+}
+
+// Size returns the approximate number of bytes occupied by the message,
+// which is the length of the json encoding of its data, plus the length of its key and headers.
+func (msg *Message) Size() int {
+	size := len(msg.Key)
+	for name, value := range msg.Headers {
+		size += len(name) + len(value)
+	}
+
+	if data, err := json.Marshal(msg.Data); err == nil {
+		size += len(data)
+	}
+	return size
+}
+
+// toJsonValue converts v to the generic representation (maps, slices, float64, ...) which
+// is used for data of messages decoded from json, so that filters can be evaluated on it.
+func toJsonValue(v interface{}) interface{} {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+
+	var res interface{}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil
+	}
+	return res
+}
@@ -0,0 +1,48 @@
+package core
+
+import "time"
+
+const meterWindow = 60
+
+// meter counts events over a sliding window of meterWindow seconds, split in one second buckets.
+type meter struct {
+	total   uint64
+	buckets [meterWindow]uint64
+	// last is the second (since the unix epoch) of the most recent bucket
+	last int64
+}
+
+// advance clears the buckets of the seconds elapsed since the last event.
+func (m *meter) advance(now int64) {
+	sec := now / int64(time.Second)
+
+	elapsed := sec - m.last
+	if elapsed > meterWindow {
+		elapsed = meterWindow
+	}
+
+	for i := int64(1); i <= elapsed; i++ {
+		m.buckets[(m.last+i)%meterWindow] = 0
+	}
+
+	if sec > m.last {
+		m.last = sec
+	}
+}
+
+func (m *meter) mark(now int64, n int) {
+	m.advance(now)
+	m.buckets[m.last%meterWindow] += uint64(n)
+	m.total += uint64(n)
+}
+
+// rate returns the average number of events per second over the window.
+func (m *meter) rate(now int64) float64 {
+	m.advance(now)
+
+	sum := uint64(0)
+	for _, n := range m.buckets {
+		sum += n
+	}
+	return float64(sum) / meterWindow
+}
@@ -0,0 +1,36 @@
+package core
+
+import (
+	"errors"
+	"path"
+	"strings"
+)
+
+var ErrInvalidPattern = errors.New("invalid stream pattern")
+
+// IsPattern reports whether name is a glob pattern (e.g. "orders.*")
+// rather than a plain stream name.
+func IsPattern(name string) bool {
+	return strings.ContainsAny(name, "*?[\\")
+}
+
+func validatePattern(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return ErrInvalidPattern
+	}
+	return nil
+}
+
+func matchPattern(pattern string, sname string) bool {
+	matched, err := path.Match(pattern, sname)
+	return err == nil && matched
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package core
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+const ringReplicas = 64
+
+type ringPoint struct {
+	hash uint32
+	c    *consumer
+}
+
+// hashRing maps message keys onto consumers through consistent hashing, so that
+// only a small fraction of keys is moved when a consumer joins or leaves.
+type hashRing struct {
+	points []ringPoint
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+func newHashRing(consumers []*consumer) *hashRing {
+	points := make([]ringPoint, 0, len(consumers)*ringReplicas)
+	for _, c := range consumers {
+		for i := 0; i < ringReplicas; i++ {
+			points = append(points, ringPoint{
+				hash: hashKey(strconv.FormatUint(c.id, 10) + "-" + strconv.Itoa(i)),
+				c:    c,
+			})
+		}
+	}
+
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].hash < points[j].hash
+	})
+	return &hashRing{points: points}
+}
+
+// lookup returns the first consumer following the key on the ring which satisfies accept, if any.
+func (r *hashRing) lookup(key string, accept func(c *consumer) bool) *consumer {
+	if len(r.points) == 0 {
+		return nil
+	}
+
+	h := hashKey(key)
+	start := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+
+	for i := 0; i < len(r.points); i++ {
+		p := r.points[(start+i)%len(r.points)]
+		if accept(p.c) {
+			return p.c
+		}
+	}
+	return nil
+}
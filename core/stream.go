@@ -1,17 +1,241 @@
 package core
 
+import (
+	"errors"
+	"time"
+)
+
+const maxPartitions = 1024
+
+var ErrInvalidStreamOptions = errors.New("invalid stream options")
+
+type StreamOptions struct {
+	// Partitions is the number of partitions of the stream (1, if not set).
+	// Messages having a key are routed to partitions by key hash, while the others are routed in round-robin.
+	Partitions int `json:"partitions"`
+	// ExpiryStream, if set, is the name of a stream receiving a notification for each message
+	// which expires before being acked by some consumer group.
+	ExpiryStream string `json:"expiryStream,omitempty"`
+	// DedupWindow and DedupMaxKeys bound, by time and count respectively, the idempotency keys
+	// remembered by the stream for detecting duplicate publishes (defaults are 2m and 10000).
+	DedupWindow  Duration `json:"dedupWindow,omitempty"`
+	DedupMaxKeys int      `json:"dedupMaxKeys,omitempty"`
+	// IdleTimeout, if set, makes the stream ephemeral: it is automatically deleted once it has had
+	// no consumers and no new messages for the given duration.
+	IdleTimeout Duration `json:"idleTimeout,omitempty"`
+	// Retention, if set, is the time after which messages without a TTL are discarded.
+	// If not set, the default retention of the broker is used.
+	Retention Duration `json:"retention,omitempty"`
+}
+
+func (opts *StreamOptions) Validate() error {
+	if opts.Partitions < 0 || opts.Partitions > maxPartitions {
+		return ErrInvalidStreamOptions
+	}
+
+	if opts.DedupWindow < 0 || opts.DedupMaxKeys < 0 || opts.IdleTimeout < 0 || opts.Retention < 0 {
+		return ErrInvalidStreamOptions
+	}
+
+	if IsPattern(opts.ExpiryStream) {
+		return ErrInvalidStreamOptions
+	}
+	return nil
+}
+
+// partition is an ordered sequence of messages, where each message is identified by its offset.
+// Removed messages leave a nil slot, which is reclaimed once it reaches the head of the partition.
+type partition struct {
+	// base is the offset of the first message in msgs
+	base uint64
+	msgs []*Message
+}
+
+func (p *partition) nextOffset() uint64 {
+	return p.base + uint64(len(p.msgs))
+}
+
+func (p *partition) remove(offset uint64) {
+	p.msgs[offset-p.base] = nil
+
+	for len(p.msgs) > 0 && p.msgs[0] == nil {
+		p.msgs = p.msgs[1:]
+		p.base++
+	}
+}
+
 type stream struct {
+	opts StreamOptions
+
+	// msgs holds the messages of all the partitions, in arrival order.
+	// As for partitions, removed messages leave a nil slot.
 	msgs []*Message
+	base uint64
+	// index maps the id of each stored message to the message itself
+	index         map[string]*Message
+	length        int
+	bytes         int
+	published     uint64
+	deleted       int
+	partitions    []*partition
+	nextPartition int
+	scheduled     int
+	dedup         *dedupWindow
+	// budget, if set, is released as messages are removed (they are charged by the broker when admitted)
+	budget *MemoryBudget
+	// lastActive is the last instant (in unix nanoseconds) at which the stream has been used
+	lastActive int64
+	// trimAt is the instant at which the stream is trimmed to enforce retention, or zero if no trim is scheduled
+	trimAt int64
 }
 
 const streamInitialBufSize = 1024
 
-func newStream() *stream {
+func newStream(opts StreamOptions) *stream {
+	nPartitions := opts.Partitions
+	if nPartitions == 0 {
+		nPartitions = 1
+	}
+
+	partitions := make([]*partition, nPartitions)
+	for i := range partitions {
+		partitions[i] = &partition{}
+	}
+
 	return &stream{
-		msgs: make([]*Message, 0, streamInitialBufSize),
+		opts:       opts,
+		msgs:       make([]*Message, 0, streamInitialBufSize),
+		index:      make(map[string]*Message),
+		partitions: partitions,
+		dedup:      newDedupWindow(time.Duration(opts.DedupWindow), opts.DedupMaxKeys),
+		lastActive: time.Now().UnixNano(),
+	}
+}
+
+func (s *stream) partitioned() bool {
+	return len(s.partitions) > 1
+}
+
+func (s *stream) route(msg *Message) int {
+	if msg.Key != "" {
+		return int(hashKey(msg.Key) % uint32(len(s.partitions)))
 	}
+
+	p := s.nextPartition
+	s.nextPartition = (s.nextPartition + 1) % len(s.partitions)
+	return p
 }
 
 func (s *stream) addMessage(msg *Message) {
+	msg.Partition = s.route(msg)
+
+	p := s.partitions[msg.Partition]
+	msg.Offset = p.nextOffset()
+	msg.seq = s.nextSeq()
+	msg.storedAt = time.Now().UnixNano()
+
+	p.msgs = append(p.msgs, msg)
 	s.msgs = append(s.msgs, msg)
+	s.index[msg.Id] = msg
+	s.length++
+	s.bytes += msg.size
+	s.published++
+}
+
+// nextSeq returns the sequence number which will be assigned to the next message appended to the stream.
+func (s *stream) nextSeq() uint64 {
+	return s.base + uint64(len(s.msgs))
+}
+
+// lastId returns the id of the last message stored inside the stream, if any.
+func (s *stream) lastId() string {
+	for i := len(s.msgs) - 1; i >= 0; i-- {
+		if s.msgs[i] != nil {
+			return s.msgs[i].Id
+		}
+	}
+	return ""
+}
+
+// position resolves a start id (see StartLatest and StartEarliest) into the sequence number of the
+// first message to be delivered, and the id of the message preceding it.
+func (s *stream) position(id string) (uint64, string, error) {
+	switch id {
+	case "", StartLatest:
+		return s.nextSeq(), s.lastId(), nil
+	case StartEarliest:
+		return 0, "", nil
+	}
+
+	msg := s.find(id)
+	if msg == nil {
+		return 0, "", ErrInvalidStartId
+	}
+	return msg.seq + 1, msg.Id, nil
+}
+
+// contains reports whether msg is still stored inside the stream.
+func (s *stream) contains(msg *Message) bool {
+	return msg.seq >= s.base && msg.seq < s.base+uint64(len(s.msgs)) && s.msgs[msg.seq-s.base] == msg
+}
+
+func (s *stream) removeMessage(msg *Message) {
+	if !s.contains(msg) {
+		return
+	}
+
+	s.msgs[msg.seq-s.base] = nil
+	for len(s.msgs) > 0 && s.msgs[0] == nil {
+		s.msgs = s.msgs[1:]
+		s.base++
+	}
+
+	s.partitions[msg.Partition].remove(msg.Offset)
+	delete(s.index, msg.Id)
+	s.length--
+	s.bytes -= msg.size
+	s.budget.add(-msg.size)
+}
+
+// find returns the message with the given id, if it is stored inside the stream.
+func (s *stream) find(id string) *Message {
+	return s.index[id]
+}
+
+func filterMessages(msgs []*Message, count int, filter *Filter) []*Message {
+	now := time.Now().UnixNano()
+
+	res := make([]*Message, 0)
+	for _, msg := range msgs {
+		if count > 0 && len(res) >= count {
+			break
+		}
+
+		if msg != nil && !msg.expired(now) && filter.Match(msg) {
+			res = append(res, msg)
+		}
+	}
+	return res
+}
+
+func (s *stream) read(after string, count int, filter *Filter) []*Message {
+	start := 0
+	if after != "" {
+		start = len(s.msgs)
+		if msg := s.find(after); msg != nil {
+			start = int(msg.seq-s.base) + 1
+		}
+	}
+	return filterMessages(s.msgs[start:], count, filter)
+}
+
+func (s *stream) readPartition(partition int, offset uint64, count int, filter *Filter) []*Message {
+	p := s.partitions[partition]
+	if offset < p.base {
+		offset = p.base
+	}
+	if offset > p.nextOffset() {
+		offset = p.nextOffset()
+	}
+	return filterMessages(p.msgs[offset-p.base:], count, filter)
 }
@@ -0,0 +1,76 @@
+package core
+
+import (
+	"container/heap"
+	"time"
+)
+
+type timerTask struct {
+	at int64
+	fn func()
+}
+
+type timerHeap []*timerTask
+
+func (h timerHeap) Len() int           { return len(h) }
+func (h timerHeap) Less(i, j int) bool { return h[i].at < h[j].at }
+func (h timerHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *timerHeap) Push(x interface{}) {
+	*h = append(*h, x.(*timerTask))
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	task := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return task
+}
+
+// timerQueue runs tasks at given instants, keeping a single timer armed on the earliest one.
+// Tasks are run by the fire function supplied at creation, which is responsible for synchronization.
+type timerQueue struct {
+	tasks timerHeap
+	timer *time.Timer
+	fire  func()
+}
+
+func newTimerQueue(fire func()) *timerQueue {
+	return &timerQueue{
+		tasks: make(timerHeap, 0),
+		fire:  fire,
+	}
+}
+
+func (q *timerQueue) schedule(at int64, fn func()) {
+	heap.Push(&q.tasks, &timerTask{at: at, fn: fn})
+
+	if q.tasks[0].at == at {
+		q.arm()
+	}
+}
+
+func (q *timerQueue) arm() {
+	if len(q.tasks) == 0 {
+		return
+	}
+
+	d := time.Duration(q.tasks[0].at - time.Now().UnixNano())
+	if q.timer == nil {
+		q.timer = time.AfterFunc(d, q.fire)
+	} else {
+		q.timer.Reset(d)
+	}
+}
+
+// runDue runs all the tasks which are due and re-arms the timer on the next one.
+func (q *timerQueue) runDue() {
+	now := time.Now().UnixNano()
+	for len(q.tasks) > 0 && q.tasks[0].at <= now {
+		task := heap.Pop(&q.tasks).(*timerTask)
+		task.fn()
+	}
+	q.arm()
+}
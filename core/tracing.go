@@ -0,0 +1,40 @@
+package core
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/ostafen/rustle/core"
+
+// propagator carries the W3C trace context of a message through its headers
+// ("traceparent" and "tracestate"), from the publisher to the consumers.
+var propagator = propagation.TraceContext{}
+
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// MessageContext returns a copy of ctx carrying the trace context stored inside the headers of the message, if any.
+func MessageContext(ctx context.Context, msg *Message) context.Context {
+	return propagator.Extract(ctx, propagation.MapCarrier(msg.Headers))
+}
+
+// InjectContext stores the trace context of ctx inside the headers of the message.
+func InjectContext(ctx context.Context, msg *Message) {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return
+	}
+
+	if msg.Headers == nil {
+		msg.Headers = make(map[string]string, len(carrier))
+	}
+	for name, value := range carrier {
+		msg.Headers[name] = value
+	}
+}
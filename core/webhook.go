@@ -0,0 +1,340 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultWebhookMaxAttempts    = 5
+	defaultWebhookInitialBackoff = 500 * time.Millisecond
+	defaultWebhookMaxBackoff     = 30 * time.Second
+	defaultWebhookTimeout        = 10 * time.Second
+)
+
+var ErrInvalidWebhook = errors.New("invalid webhook options")
+
+// WebhookOptions configures push delivery of the messages of a consumer group to an http endpoint.
+// Messages are POSTed to URL (as a json array, if BatchSize is greater than one), and a 2xx response acks them.
+// Failed batches stay pending, and they are retried with exponential backoff while new messages keep being delivered.
+// After MaxAttempts attempts, messages are appended to DeadLetterStream (if set, it must exist when the group is created)
+// and acked. Without a dead letter
+// stream, they are left pending (so that they can be redelivered by moving the cursor of the group back),
+// unless DropUndelivered is set, in which case they are acked and dropped.
+type WebhookOptions struct {
+	URL string `json:"url"`
+	// Streams holds the names (or glob patterns) of the streams whose messages are pushed to the webhook
+	Streams          []string `json:"streams"`
+	BatchSize        int      `json:"batchSize,omitempty"`
+	MaxAttempts      int      `json:"maxAttempts,omitempty"`
+	InitialBackoff   Duration `json:"initialBackoff,omitempty"`
+	MaxBackoff       Duration `json:"maxBackoff,omitempty"`
+	Timeout          Duration `json:"timeout,omitempty"`
+	DeadLetterStream string   `json:"deadLetterStream,omitempty"`
+	DropUndelivered  bool     `json:"dropUndelivered,omitempty"`
+}
+
+func (opts *WebhookOptions) Validate() error {
+	u, err := url.Parse(opts.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrInvalidWebhook
+	}
+
+	if len(opts.Streams) == 0 || opts.BatchSize < 0 || opts.MaxAttempts < 0 {
+		return ErrInvalidWebhook
+	}
+
+	if opts.InitialBackoff < 0 || opts.MaxBackoff < 0 || opts.Timeout < 0 {
+		return ErrInvalidWebhook
+	}
+	return nil
+}
+
+func (opts *WebhookOptions) withDefaults() WebhookOptions {
+	res := *opts
+	if res.BatchSize == 0 {
+		res.BatchSize = 1
+	}
+	if res.MaxAttempts == 0 {
+		res.MaxAttempts = defaultWebhookMaxAttempts
+	}
+	if res.InitialBackoff == 0 {
+		res.InitialBackoff = Duration(defaultWebhookInitialBackoff)
+	}
+	if res.MaxBackoff == 0 {
+		res.MaxBackoff = Duration(defaultWebhookMaxBackoff)
+	}
+	if res.Timeout == 0 {
+		res.Timeout = Duration(defaultWebhookTimeout)
+	}
+	return res
+}
+
+// webhook is the delivery loop of a consumer pushing messages to an http endpoint.
+type webhook struct {
+	c      *consumer
+	b      *Broker
+	opts   WebhookOptions
+	client *http.Client
+
+	// retries holds the batches waiting for a new attempt, ordered by due time,
+	// and retrying is the number of messages they contain
+	retries  []*webhookRetry
+	retrying int
+}
+
+type webhookRetry struct {
+	batch    []*Message
+	failures int
+	due      time.Time
+}
+
+// startWebhook runs the delivery loop of a consumer pushing messages to a webhook.
+func (c *consumer) startWebhook(b *Broker, opts WebhookOptions) {
+	w := &webhook{
+		c:      c,
+		b:      b,
+		opts:   opts,
+		client: &http.Client{Timeout: time.Duration(opts.Timeout)},
+	}
+
+	c.wg.Add(1)
+	go w.run()
+}
+
+func (w *webhook) run() {
+	c := w.c
+	defer func() {
+		close(c.done)
+		c.wg.Done()
+	}()
+
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		// the buffer is only read while the retry queue has room, so that messages
+		// are held inside their streams if the endpoint keeps failing
+		var in chan *Message
+		if w.retrying < cap(c.outCh) {
+			in = c.outCh
+		}
+
+		var due <-chan time.Time
+		if len(w.retries) > 0 {
+			resetTimer(timer, time.Until(w.retries[0].due))
+			due = timer.C
+		}
+
+		select {
+		case <-c.quit:
+			return
+		case <-c.draining:
+			w.flush()
+			return
+		case msg := <-in:
+			c.freed()
+			w.attempt(c.nextBatch(msg, w.opts.BatchSize), 0)
+		case <-due:
+			r := w.retries[0]
+			w.retries = w.retries[1:]
+			w.retrying -= len(r.batch)
+			w.attempt(r.batch, r.failures)
+		}
+	}
+}
+
+// flush makes a single attempt to deliver the messages left inside the buffer. Batches waiting for a retry are left pending.
+func (w *webhook) flush() {
+	for {
+		select {
+		case msg := <-w.c.outCh:
+			w.c.freed()
+			batch := w.c.nextBatch(msg, w.opts.BatchSize)
+			if len(batch) > 0 && w.push(batch) == nil {
+				w.b.AckMessages(context.Background(), w.c.group, ackMap(batch))
+			}
+		default:
+			return
+		}
+	}
+}
+
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+// attempt pushes a batch which already failed the given number of times, then acks it. If the push fails,
+// the batch is queued for a retry, or, once all the attempts are exhausted, it is handled by undelivered.
+// Acks don't block, since the broker never waits for consumers while holding its lock.
+func (w *webhook) attempt(batch []*Message, failures int) {
+	batch = unexpired(batch)
+	if len(batch) == 0 {
+		return
+	}
+
+	if w.push(batch) == nil {
+		w.b.AckMessages(context.Background(), w.c.group, ackMap(batch))
+		return
+	}
+
+	failures++
+	if failures >= w.opts.MaxAttempts {
+		w.b.undelivered(w.c.group, w.opts, batch)
+		return
+	}
+
+	backoff := time.Duration(w.opts.InitialBackoff)
+	for i := 1; i < failures && backoff < time.Duration(w.opts.MaxBackoff); i++ {
+		backoff *= 2
+	}
+	if backoff > time.Duration(w.opts.MaxBackoff) {
+		backoff = time.Duration(w.opts.MaxBackoff)
+	}
+	w.retry(&webhookRetry{batch: batch, failures: failures, due: time.Now().Add(backoff)})
+}
+
+// retry inserts a batch inside the retry queue, keeping it ordered by due time.
+func (w *webhook) retry(r *webhookRetry) {
+	i := sort.Search(len(w.retries), func(i int) bool {
+		return w.retries[i].due.After(r.due)
+	})
+
+	w.retries = append(w.retries, nil)
+	copy(w.retries[i+1:], w.retries[i:])
+	w.retries[i] = r
+	w.retrying += len(r.batch)
+}
+
+// nextBatch collects, without blocking, up to size non expired messages from the consumer buffer.
+func (c *consumer) nextBatch(first *Message, size int) []*Message {
+	batch := make([]*Message, 0, size)
+	batch = append(batch, first)
+
+	for len(batch) < size {
+		select {
+		case msg := <-c.outCh:
+			c.freed()
+			batch = append(batch, msg)
+		default:
+			return unexpired(batch)
+		}
+	}
+	return unexpired(batch)
+}
+
+func unexpired(msgs []*Message) []*Message {
+	now := time.Now().UnixNano()
+
+	res := msgs[:0]
+	for _, msg := range msgs {
+		if !msg.expired(now) {
+			res = append(res, msg)
+		}
+	}
+	return res
+}
+
+// push makes a single attempt to deliver a batch to the webhook, which is traced by a delivery span for each message.
+func (w *webhook) push(batch []*Message) error {
+	spans := make([]trace.Span, 0, len(batch))
+	for _, msg := range batch {
+		spans = append(spans, w.c.startDelivery(msg))
+	}
+
+	var body interface{} = batch
+	if w.opts.BatchSize == 1 {
+		body = batch[0]
+	}
+
+	data, err := json.Marshal(body)
+	if err == nil {
+		err = postWebhook(w.client, w.opts.URL, data)
+	}
+
+	for _, span := range spans {
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+	return err
+}
+
+func postWebhook(client *http.Client, url string, data []byte) error {
+	resp, err := client.Post(url, "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func ackMap(msgs []*Message) map[string][]string {
+	acks := make(map[string][]string)
+	for _, msg := range msgs {
+		acks[msg.Stream] = append(acks[msg.Stream], msg.Id)
+	}
+	return acks
+}
+
+// undelivered handles the messages which a webhook failed to deliver for all the attempts. They are appended to the
+// dead letter stream, if any, and removed from the pending list. Without a dead letter stream, they are kept pending,
+// unless opts.DropUndelivered is set.
+// Dead lettered messages keep the data, key and headers of the original ones, and report the
+// original stream and id through the "dead-letter-stream" and "dead-letter-id" headers.
+func (b *Broker) undelivered(cgroup string, opts WebhookOptions, msgs []*Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.streams[opts.DeadLetterStream]
+	if !ok && !opts.DropUndelivered {
+		return
+	}
+
+	if ok {
+		for _, msg := range msgs {
+			dead := NewMessage(opts.DeadLetterStream, msg.Data)
+			dead.Key = msg.Key
+			dead.Headers = make(map[string]string, len(msg.Headers)+3)
+			for name, value := range msg.Headers {
+				dead.Headers[name] = value
+			}
+			dead.Headers["dead-letter-stream"] = msg.Stream
+			dead.Headers["dead-letter-id"] = msg.Id
+			dead.Headers["dead-letter-group"] = cgroup
+
+			b.appendMessage(s, dead)
+		}
+	}
+
+	// dead lettered and dropped messages are removed from the pending list, and counted as nacked rather than acked
+	if group, ok := b.cGroups[cgroup]; ok {
+		for _, msg := range msgs {
+			if subscription := group.subscriptions[msg.Stream]; subscription != nil {
+				subscription.nacked += uint64(subscription.ackMessages([]string{msg.Id}))
+			}
+		}
+	}
+}
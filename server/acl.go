@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/ostafen/rustle/core"
+)
+
+// principal returns the principal of the client issuing the request, or an empty string if it is anonymous.
+func principal(r *http.Request) string {
+	if id, ok := IdentityFromContext(r.Context()); ok {
+		return id.Principal
+	}
+	return ""
+}
+
+// authorize reports whether the client has the given permission on all the resources, responding
+// with 403 if it hasn't. Requests are always authorized if no ACL is configured.
+func authorize(acl *core.ACL, w http.ResponseWriter, r *http.Request, perm core.Permission, resources ...string) bool {
+	if acl == nil {
+		return true
+	}
+
+	p := principal(r)
+	for _, resource := range resources {
+		if !acl.Allowed(p, perm, resource) {
+			w.WriteHeader(http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+// visible reports whether the client has any permission on a resource, and it is used to filter listings.
+func visible(acl *core.ACL, r *http.Request, resource string) bool {
+	return acl == nil || acl.Visible(principal(r), resource)
+}
+
+func (c *controller) authorize(w http.ResponseWriter, r *http.Request, perm core.Permission, resources ...string) bool {
+	return authorize(c.acl, w, r, perm, resources...)
+}
+
+func (c *controller) visible(r *http.Request, resource string) bool {
+	return visible(c.acl, r, resource)
+}
+
+// qualify prefixes the name of a stream or group with its namespace, so that it is unique across namespaces
+// (e.g. inside ACL rules and metrics). Names belonging to the default namespace are left unchanged.
+func (c *controller) qualify(name string) string {
+	if c.namespace == DefaultNamespace {
+		return name
+	}
+	return c.namespace + "/" + name
+}
+
+func (c *controller) streamResource(name string) string {
+	return core.StreamResource(c.qualify(name))
+}
+
+func (c *controller) groupResource(name string) string {
+	return core.GroupResource(c.qualify(name))
+}
+
+// requireAdmin wraps a handler, so that it is only served to clients having the admin permission on the broker.
+func requireAdmin(acl *core.ACL, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authorize(acl, w, r, core.PermAdmin, core.BrokerResource) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// handleRules serves the admin API for listing, adding and replacing the rules of the ACL.
+func (n *namespaces) handleRules(w http.ResponseWriter, r *http.Request) {
+	if n.acl == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if !authorize(n.acl, w, r, core.PermAdmin, core.BrokerResource) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		writeJsonBody(w, n.acl.Rules())
+	case "POST":
+		rule := core.Rule{}
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		rule, err := n.acl.AddRule(rule)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		writeJsonBody(w, rule)
+	case "PUT":
+		rules := make([]core.Rule, 0)
+		if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if err := n.acl.SetRules(rules); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		writeJsonBody(w, n.acl.Rules())
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (n *namespaces) handleRule(w http.ResponseWriter, r *http.Request) {
+	if n.acl == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if !authorize(n.acl, w, r, core.PermAdmin, core.BrokerResource) {
+		return
+	}
+
+	if r.Method != "DELETE" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil || !n.acl.RemoveRule(id) {
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// ErrNoCredentials is returned by an Authenticator when the request carries no credentials it can check,
+	// so that the next authenticator is tried.
+	ErrNoCredentials      = errors.New("no credentials")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Identity is the authenticated identity of the client issuing a request.
+type Identity struct {
+	Principal string
+	// Method is the authentication method, e.g. "apikey" or "jwt"
+	Method string
+}
+
+// Authenticator extracts and verifies the credentials of a request.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+type identityKey struct{}
+
+// IdentityFromContext returns the identity of the client, if the request has been authenticated.
+func IdentityFromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(*Identity)
+	return id, ok
+}
+
+// authenticate is a middleware rejecting requests which are not accepted by any of the authenticators.
+// The identity of the client is made available to handlers through IdentityFromContext.
+// If no authenticator is configured, requests are not authenticated.
+func authenticate(authenticators []Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(authenticators) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, a := range authenticators {
+				id, err := a.Authenticate(r)
+				if errors.Is(err, ErrNoCredentials) {
+					continue
+				}
+
+				if err != nil {
+					break
+				}
+
+				trace.SpanFromContext(r.Context()).SetAttributes(semconv.EnduserIDKey.String(id.Principal))
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+				return
+			}
+
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+		})
+	}
+}
+
+// APIKeyHeader is the header carrying API keys.
+const APIKeyHeader = "X-API-Key"
+
+// APIKeys authenticates requests carrying a static key through the APIKeyHeader header.
+// It maps each key to the principal owning it.
+type APIKeys map[string]string
+
+func (keys APIKeys) Authenticate(r *http.Request) (*Identity, error) {
+	key := r.Header.Get(APIKeyHeader)
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+
+	// keys are compared in constant time, so that they can't be guessed by timing requests
+	for k, principal := range keys {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			return &Identity{Principal: principal, Method: "apikey"}, nil
+		}
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// JWTVerifier authenticates requests carrying a JWT through the "Authorization: Bearer" header.
+// The principal is the subject of the token.
+type JWTVerifier struct {
+	// Keys maps key ids to the keys tokens are verified against. Supported keys are []byte (for HMAC),
+	// *rsa.PublicKey and ed25519.PublicKey. Tokens having a "kid" header are only verified
+	// against the key with that id, while the other ones are verified against each key.
+	Keys map[string]interface{}
+	// Issuer and Audience, if set, must match the "iss" and "aud" claims of tokens
+	Issuer   string
+	Audience string
+}
+
+func (v *JWTVerifier) Authenticate(r *http.Request) (*Identity, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, ErrNoCredentials
+	}
+	tokenString := strings.TrimPrefix(auth, "Bearer ")
+
+	for _, key := range v.candidateKeys(tokenString) {
+		claims := &jwt.RegisteredClaims{}
+		if _, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+			return key, checkMethod(token.Method, key)
+		}); err != nil {
+			continue
+		}
+
+		if claims.Subject == "" || (v.Issuer != "" && !claims.VerifyIssuer(v.Issuer, true)) ||
+			(v.Audience != "" && !claims.VerifyAudience(v.Audience, true)) {
+			return nil, ErrInvalidCredentials
+		}
+		return &Identity{Principal: claims.Subject, Method: "jwt"}, nil
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// candidateKeys returns the keys a token should be verified against, according to its "kid" header.
+func (v *JWTVerifier) candidateKeys(tokenString string) []interface{} {
+	token, _, err := new(jwt.Parser).ParseUnverified(tokenString, jwt.MapClaims{})
+	if err != nil {
+		return nil
+	}
+
+	if kid, ok := token.Header["kid"].(string); ok {
+		if key, ok := v.Keys[kid]; ok {
+			return []interface{}{key}
+		}
+		return nil
+	}
+
+	keys := make([]interface{}, 0, len(v.Keys))
+	for _, key := range v.Keys {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// checkMethod ensures that the signing method of a token is compatible with the key,
+// so that, for example, a public RSA key can't be used as an HMAC secret.
+func checkMethod(method jwt.SigningMethod, key interface{}) error {
+	ok := false
+	switch key.(type) {
+	case []byte:
+		_, ok = method.(*jwt.SigningMethodHMAC)
+	case *rsa.PublicKey:
+		switch method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+			ok = true
+		}
+	case ed25519.PublicKey:
+		_, ok = method.(*jwt.SigningMethodEd25519)
+	}
+
+	if !ok {
+		return fmt.Errorf("unexpected signing method %s", method.Alg())
+	}
+	return nil
+}
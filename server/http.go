@@ -1,9 +1,15 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"github.com/ostafen/rustle/core"
+	"io"
+	"log"
 	"net/http"
+	"strconv"
+	"sync"
 
 	"github.com/gorilla/mux"
 )
@@ -18,10 +24,16 @@ func writeJsonBody(rw http.ResponseWriter, v interface{}) {
 }
 
 type flushWriter struct {
-	w http.ResponseWriter
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	started bool
 }
 
 func (fw *flushWriter) Write(data []byte) (int, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	fw.started = true
 	n, err := fw.w.Write(data)
 	if err == nil {
 		fw.w.(http.Flusher).Flush()
@@ -29,8 +41,47 @@ func (fw *flushWriter) Write(data []byte) (int, error) {
 	return n, err
 }
 
+// start sends the response headers, unless some data has already been written.
+func (fw *flushWriter) start() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if !fw.started {
+		fw.started = true
+		fw.w.WriteHeader(http.StatusOK)
+		fw.w.(http.Flusher).Flush()
+	}
+}
+
+// writeError responds with the status code matching an error of the broker, which is 404 for unknown errors,
+// since most operations fail because the target stream or group doesn't exist. Only rate quotas are reported
+// with 429, since exceeding the other ones is not fixed by retrying.
+func writeError(w http.ResponseWriter, err error) {
+	var quotaErr *core.QuotaError
+
+	switch {
+	case errors.Is(err, core.ErrShuttingDown):
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case errors.Is(err, core.ErrMemoryExhausted):
+		w.WriteHeader(http.StatusInsufficientStorage)
+	case errors.As(err, &quotaErr) && quotaErr.RetryAfter > 0:
+		setRetryAfter(w, quotaErr.RetryAfter)
+		w.WriteHeader(http.StatusTooManyRequests)
+	case errors.As(err, &quotaErr) && quotaErr.Quota == core.QuotaMemory:
+		w.WriteHeader(http.StatusInsufficientStorage)
+	case errors.As(err, &quotaErr):
+		w.WriteHeader(http.StatusConflict)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
 type controller struct {
-	b *core.Broker
+	namespace string
+	b         *core.Broker
+	limiter   *rateLimiter
+	// acl, if set, authorizes the requests of each handler
+	acl *core.ACL
 }
 
 func (c *controller) handleListStreams(w http.ResponseWriter, r *http.Request) {
@@ -40,7 +91,12 @@ func (c *controller) handleListStreams(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 
-	channels := c.b.ListStreams()
+	channels := make([]core.StreamInfo, 0)
+	for _, info := range c.b.ListStreams() {
+		if c.visible(r, c.streamResource(info.Name)) {
+			channels = append(channels, info)
+		}
+	}
 	writeJsonBody(w, channels)
 }
 
@@ -50,26 +106,176 @@ func (c *controller) handleStreams(w http.ResponseWriter, r *http.Request) {
 
 	switch r.Method {
 	case "PUT":
-		if c.b.CreateStream(name) {
-			w.WriteHeader(http.StatusCreated)
-		} else {
+		if !c.authorize(w, r, core.PermCreate, c.streamResource(name)) {
+			return
+		}
+
+		opts := &core.StreamOptions{}
+		if err := json.NewDecoder(r.Body).Decode(opts); err != nil && err != io.EOF {
+			w.WriteHeader(http.StatusBadRequest)
+		} else if core.IsPattern(name) || opts.Validate() != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		} else if err := c.b.CreateStream(name, opts); errors.Is(err, core.ErrStreamExists) {
 			w.WriteHeader(http.StatusConflict)
+		} else if err != nil {
+			writeError(w, err)
+		} else {
+			w.WriteHeader(http.StatusCreated)
 		}
 	case "POST":
-		var body interface{}
-		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		if !c.authorize(w, r, core.PermPublish, c.streamResource(name)) || !c.limiter.limitBody(w, r) {
+			return
+		}
+
+		msg, err := decodeMessage(r, name)
+		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
-		} else {
-			c.b.NotifyMessage(core.NewMessage(name, body))
+			return
+		}
+
+		reservations, ok := c.throttle(w, r, []*core.Message{msg})
+		if !ok {
+			return
+		}
+
+		msg, duplicate, err := c.b.NotifyMessage(msg)
+		if err != nil {
+			c.limiter.refund(reservations)
+			writeError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		writeJsonBody(w, newPublishResponse(msg, duplicate))
+	case "GET":
+		if c.authorize(w, r, core.PermSubscribe, c.streamResource(name)) {
+			c.readStream(w, r, name)
+		}
+	case "DELETE":
+		if c.authorize(w, r, core.PermDelete, c.streamResource(name)) {
+			c.b.DeleteStream(name)
+			c.limiter.forget(c.qualify(name))
+		}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// parseFilter returns the filter expression supplied through the "filter" query parameter, if any.
+func parseFilter(r *http.Request) (*core.Filter, error) {
+	expr := r.FormValue("filter")
+	if expr == "" {
+		return nil, nil
+	}
+	return core.ParseFilter(expr)
+}
+
+func (c *controller) readStream(w http.ResponseWriter, r *http.Request, name string) {
+	filter, err := parseFilter(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	count := 0
+	if countParam := r.FormValue("count"); countParam != "" {
+		count, err = strconv.Atoi(countParam)
+		if err != nil || count < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	var msgs []*core.Message
+	if partitionParam := r.FormValue("partition"); partitionParam != "" {
+		var partition int
+		var offset uint64
+		if partition, err = strconv.Atoi(partitionParam); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if offsetParam := r.FormValue("offset"); offsetParam != "" {
+			if offset, err = strconv.ParseUint(offsetParam, 10, 64); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
 		}
+		msgs, err = c.b.ReadPartition(name, partition, offset, count, filter)
+	} else {
+		msgs, err = c.b.ReadStream(name, r.FormValue("after"), count, filter)
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJsonBody(w, msgs)
+}
+
+func (c *controller) handleMessages(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
 	case "GET":
-		/*if !c.b.HasStream(name) {
+		c.handleStreamSubscription(w, r)
+	case "DELETE":
+		if !c.authorize(w, r, core.PermDelete, c.streamResource(mux.Vars(r)["name"])) {
+			return
+		}
+
+		ids := make([]string, 0)
+		if err := json.NewDecoder(r.Body).Decode(&ids); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		c.deleteMessages(w, mux.Vars(r)["name"], ids)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+type deleteResponse struct {
+	Deleted int `json:"deleted"`
+}
+
+func (c *controller) deleteMessages(w http.ResponseWriter, stream string, ids []string) {
+	n, err := c.b.DeleteMessages(stream, ids)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJsonBody(w, &deleteResponse{Deleted: n})
+}
+
+func (c *controller) handleMessage(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	switch r.Method {
+	case "GET":
+		if !c.authorize(w, r, core.PermSubscribe, c.streamResource(vars["name"])) {
+			return
+		}
+
+		msg, err := c.b.GetMessage(vars["name"], vars["id"])
+		if err != nil {
 			w.WriteHeader(http.StatusNotFound)
-		} else {
-			c.streamMessages(w, r, cgroup, name)
-		}*/
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		writeJsonBody(w, msg)
 	case "DELETE":
-		c.b.DeleteStream(name)
+		if !c.authorize(w, r, core.PermDelete, c.streamResource(vars["name"])) {
+			return
+		}
+
+		n, err := c.b.DeleteMessages(vars["name"], []string{vars["id"]})
+		if err != nil || n == 0 {
+			w.WriteHeader(http.StatusNotFound)
+		}
 	default:
 		w.WriteHeader(http.StatusBadRequest)
 	}
@@ -82,18 +288,40 @@ func (c *controller) handleStreamSubscription(rw http.ResponseWriter, r *http.Re
 	rw.Header().Set("Connection", "keep-alive")
 	rw.Header().Set("Access-Control-Allow-Origin", "*")
 
-	fw := &flushWriter{rw}
+	fw := &flushWriter{w: rw}
 
 	cGroup := r.FormValue("cgroup")
 	stream := mux.Vars(r)["name"]
 
-	consumer, err := c.b.RegisterConsumer(cGroup, fw, stream)
+	if !c.authorize(rw, r, core.PermSubscribe, c.streamResource(stream), c.groupResource(cGroup)) {
+		return
+	}
+
+	filter, err := parseFilter(r)
 	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	consumer, err := c.b.RegisterConsumer(cGroup, r.FormValue("consumer"), fw, filter, stream)
+	if errors.Is(err, core.ErrInvalidPattern) {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	} else if errors.Is(err, core.ErrConsumerExists) {
+		rw.WriteHeader(http.StatusConflict)
+		return
+	} else if errors.Is(err, core.ErrShuttingDown) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
 		rw.WriteHeader(http.StatusNotFound)
 		return
 	}
 	defer c.b.UnregisterConsumer(consumer)
 
+	// send headers right away, so that clients know when the subscription is active
+	fw.start()
+
 	go func() {
 		<-r.Context().Done()
 		consumer.Stop()
@@ -102,26 +330,109 @@ func (c *controller) handleStreamSubscription(rw http.ResponseWriter, r *http.Re
 	consumer.Join()
 }
 
+func (c *controller) handleListGroups(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	groups := make([]*core.ConsumerGroupInfo, 0)
+	for _, info := range c.b.ListGroups() {
+		if c.visible(r, c.groupResource(info.Name)) {
+			groups = append(groups, info)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJsonBody(w, groups)
+}
+
 func (c *controller) handleGroups(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	groupName := vars["name"]
 
 	switch r.Method {
 	case "PUT":
-		if c.b.CreateGroup(groupName) {
-			w.WriteHeader(http.StatusCreated)
-		} else {
+		opts := &core.GroupOptions{}
+		if err := json.NewDecoder(r.Body).Decode(opts); err != nil && err != io.EOF {
+			w.WriteHeader(http.StatusBadRequest)
+		} else if opts.Validate() != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		} else if !c.authorize(w, r, core.PermCreate, c.groupResource(groupName)) ||
+			!c.authorize(w, r, core.PermSubscribe, c.groupStreams(opts)...) {
+			return
+		} else if err := c.b.CreateGroup(groupName, opts); errors.Is(err, core.ErrGroupExists) {
 			w.WriteHeader(http.StatusConflict)
+		} else if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		} else {
+			w.WriteHeader(http.StatusCreated)
 		}
 	case "GET":
 		info, err := c.b.GetConsumerGroupInfos(groupName)
-		if err != nil {
+		if err == nil && !c.visible(r, c.groupResource(groupName)) {
+			w.WriteHeader(http.StatusForbidden)
+		} else if err != nil {
 			w.WriteHeader(http.StatusNotFound)
 		} else {
+			w.Header().Set("Content-Type", "application/json")
 			writeJsonBody(w, info)
 		}
 	case "DELETE":
-		c.b.DeleteGroup(groupName)
+		force, _ := strconv.ParseBool(r.FormValue("force"))
+		if !c.authorize(w, r, core.PermDelete, c.groupResource(groupName)) {
+			return
+		} else if err := c.b.DeleteGroup(groupName, force); errors.Is(err, core.ErrGroupHasConsumers) {
+			w.WriteHeader(http.StatusConflict)
+		} else if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+}
+
+type setIdRequest struct {
+	Id string `json:"id"`
+}
+
+func (c *controller) handleSetId(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	vars := mux.Vars(r)
+	if !c.authorize(w, r, core.PermAdmin, c.groupResource(vars["name"])) {
+		return
+	}
+
+	req := &setIdRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := c.b.SetGroupCursor(vars["name"], vars["stream"], req.Id); errors.Is(err, core.ErrInvalidStartId) {
+		w.WriteHeader(http.StatusBadRequest)
+	} else if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (c *controller) handleConsumer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	vars := mux.Vars(r)
+	if !c.authorize(w, r, core.PermAdmin, c.groupResource(vars["name"])) {
+		return
+	}
+
+	if err := c.b.RemoveConsumer(vars["name"], vars["consumer"]); errors.Is(err, core.ErrWebhookConsumer) {
+		w.WriteHeader(http.StatusConflict)
+	} else if err != nil {
+		w.WriteHeader(http.StatusNotFound)
 	}
 }
 
@@ -133,6 +444,10 @@ func (c *controller) handlePending(w http.ResponseWriter, r *http.Request) {
 	streamName := mux.Vars(r)["name"]
 	groupName := r.FormValue("cgroup")
 
+	if !c.authorize(w, r, core.PermAck, c.groupResource(groupName)) {
+		return
+	}
+
 	pending, err := c.b.ListPending(streamName, groupName)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
@@ -148,6 +463,9 @@ func (c *controller) handleAck(w http.ResponseWriter, r *http.Request) {
 	}
 
 	groupName := r.FormValue("cgroup")
+	if !c.authorize(w, r, core.PermAck, c.groupResource(groupName)) {
+		return
+	}
 
 	acks := make(map[string][]string)
 	if err := json.NewDecoder(r.Body).Decode(&acks); err != nil {
@@ -155,29 +473,169 @@ func (c *controller) handleAck(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := c.b.AckMessages(groupName, acks); err != nil {
+	if err := c.b.AckMessages(r.Context(), groupName, acks); err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 }
 
-func newController() *controller {
+// groupStreams returns the resources of the streams a group is bound to on creation.
+func (c *controller) groupStreams(opts *core.GroupOptions) []string {
+	resources := make([]string, 0, len(opts.Streams))
+	for sname := range opts.Streams {
+		resources = append(resources, c.streamResource(sname))
+	}
+	if opts.Webhook != nil {
+		for _, sname := range opts.Webhook.Streams {
+			resources = append(resources, c.streamResource(sname))
+		}
+	}
+	return resources
+}
+
+func newController(namespace string, opts *core.BrokerOptions, acl *core.ACL, limiter *rateLimiter) *controller {
 	return &controller{
-		b: core.NewBroker(),
+		namespace: namespace,
+		b:         core.NewBroker(opts),
+		limiter:   limiter,
+		acl:       acl,
+	}
+}
+
+// Options configures the http server. Zero values are replaced by defaults.
+type Options struct {
+	// Addr is the address to listen on (":8080", if not set)
+	Addr   string
+	Broker core.BrokerOptions
+	// Logger is used for logging requests (the standard logger, if not set)
+	Logger   *log.Logger
+	LogLevel LogLevel
+	// Namespaces maps the names of the namespaces to create at startup to their quotas.
+	// The quotas of the default namespace are set through Broker.
+	Namespaces map[string]core.Quotas
+	RateLimits RateLimits
+	// Authenticators, if any, are tried in order for each request, and requests
+	// which are not accepted by any of them are rejected (see IdentityFromContext)
+	Authenticators []Authenticator
+	// ACL, if set, authorizes requests according to the principal of the client (which is
+	// empty for anonymous clients). Its rules can be managed at runtime through the /acl/rules endpoints.
+	ACL *core.ACL
+	// TLS, if set, makes the server serve https
+	TLS *TLSOptions
+	// MetricsAuth makes /metrics require the admin permission on any resource. Otherwise, metrics are
+	// served without authentication, so that they can be collected by plain Prometheus scrapers.
+	MetricsAuth bool
+}
+
+const defaultAddr = ":8080"
+
+// Server is an http server exposing the brokers of its namespaces.
+type Server struct {
+	*http.Server
+	ns  *namespaces
+	tls *TLSOptions
+}
+
+// ListenAndServe listens on the configured address, serving https if TLS options are set.
+func (s *Server) ListenAndServe() error {
+	if s.tls == nil {
+		return s.Server.ListenAndServe()
 	}
+
+	conf, err := newTLSConfig(s.tls)
+	if err != nil {
+		return err
+	}
+	s.TLSConfig = conf
+
+	// certificates are supplied by the tls configuration, so that they can be reloaded
+	return s.Server.ListenAndServeTLS("", "")
 }
 
-func NewHTTPServer(addr string) *http.Server {
-	c := newController()
+// Shutdown gracefully stops the server: the brokers stop accepting new publishes and subscriptions,
+// and connected consumers receive the messages buffered for them before being disconnected.
+// Then, the http server is shut down as by http.Server.Shutdown. If ctx expires first,
+// the remaining connections are closed and the error of ctx is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	var err error
+	for _, c := range s.ns.list() {
+		if brokerErr := c.b.Shutdown(ctx); brokerErr != nil {
+			err = brokerErr
+		}
+	}
+
+	if httpErr := s.Server.Shutdown(ctx); httpErr != nil {
+		s.Server.Close()
+		return httpErr
+	}
+	return err
+}
+
+// handleBroker registers the routes served by the broker of a namespace.
+func handleBroker(r *mux.Router, n *namespaces) {
+	r.HandleFunc("/streams", n.route((*controller).handleListStreams))
+	r.HandleFunc("/streams/{name}", n.route((*controller).handleStreams))
+	r.HandleFunc("/streams/{name}/messages", n.route((*controller).handleMessages))
+	r.HandleFunc("/streams/{name}/messages/pending", n.route((*controller).handlePending))
+	r.HandleFunc("/streams/{name}/messages/{id}", n.route((*controller).handleMessage))
+	r.HandleFunc("/ack", n.route((*controller).handleAck))
+	r.HandleFunc("/tx", n.route((*controller).handleTx))
+	r.HandleFunc("/groups", n.route((*controller).handleListGroups))
+	r.HandleFunc("/groups/{name}", n.route((*controller).handleGroups))
+	r.HandleFunc("/groups/{name}/streams/{stream}/setid", n.route((*controller).handleSetId))
+	r.HandleFunc("/groups/{name}/consumers/{consumer}", n.route((*controller).handleConsumer))
+}
+
+func NewHTTPServer(opts *Options) *Server {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	addr := opts.Addr
+	if addr == "" {
+		addr = defaultAddr
+	}
+
+	logger := opts.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	n := newNamespaces(opts.Broker, opts.ACL, newRateLimiter(opts.RateLimits))
+	for name, quotas := range opts.Namespaces {
+		if name == DefaultNamespace {
+			continue
+		}
+
+		if err := n.create(name, quotas); err != nil {
+			logger.Printf("unable to create namespace %s: %s", name, err)
+		}
+	}
+	m := newMetrics(n)
+
 	r := mux.NewRouter()
-	r.HandleFunc("/streams", c.handleListStreams)
-	r.HandleFunc("/streams/{name}", c.handleStreams)
-	r.HandleFunc("/streams/{name}/messages", c.handleStreamSubscription)
-	r.HandleFunc("/streams/{name}/messages/pending", c.handlePending)
-	r.HandleFunc("/ack", c.handleAck)
-	r.HandleFunc("/groups/{name}", c.handleGroups)
-	return &http.Server{
-		Addr:    addr,
-		Handler: r,
+	r.Use(m.instrument, traceRequests, logRequests(logger, opts.LogLevel))
+	if !opts.MetricsAuth {
+		r.Handle("/metrics", m.handler())
+	}
+
+	api := r.NewRoute().Subrouter()
+	api.Use(authenticate(opts.Authenticators))
+	if opts.MetricsAuth {
+		api.Handle("/metrics", requireAdmin(opts.ACL, m.handler()))
+	}
+	api.HandleFunc("/acl/rules", n.handleRules)
+	api.HandleFunc("/acl/rules/{id}", n.handleRule)
+	api.HandleFunc("/ns", n.handleListNamespaces)
+	api.HandleFunc("/ns/{namespace}", n.handleNamespace)
+	handleBroker(api.PathPrefix("/ns/{namespace}").Subrouter(), n)
+	handleBroker(api, n)
+	return &Server{
+		Server: &http.Server{
+			Addr:    addr,
+			Handler: r,
+		},
+		ns:  n,
+		tls: opts.TLS,
 	}
 }
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type LogLevel int
+
+// LogInfo is the zero value, so that it is the default level.
+const (
+	LogDebug LogLevel = iota - 1
+	LogInfo
+	LogError
+)
+
+// ParseLogLevel parses one of "debug", "info" and "error".
+func ParseLogLevel(s string) (LogLevel, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LogDebug, nil
+	case "info":
+		return LogInfo, nil
+	case "error":
+		return LogError, nil
+	}
+	return LogInfo, fmt.Errorf("unknown log level \"%s\"", s)
+}
+
+// logRequests is a middleware logging failed requests, as well as every request if the level is LogDebug.
+func logRequests(logger *log.Logger, level LogLevel) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
+			rec := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(rec, r)
+
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+
+			if level == LogDebug || rec.status >= http.StatusInternalServerError {
+				logger.Printf("%s %s %d %s", r.Method, r.URL.Path, rec.status, time.Since(start))
+			}
+		})
+	}
+}
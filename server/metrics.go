@@ -0,0 +1,179 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	streamPublishedDesc = prometheus.NewDesc(
+		"rustle_stream_published_total", "Total number of messages appended to the stream.", []string{"stream"}, nil)
+	streamLengthDesc = prometheus.NewDesc(
+		"rustle_stream_length", "Number of messages stored inside the stream.", []string{"stream"}, nil)
+	streamBytesDesc = prometheus.NewDesc(
+		"rustle_stream_bytes", "Approximate size of the messages stored inside the stream.", []string{"stream"}, nil)
+
+	groupDeliveredDesc = prometheus.NewDesc(
+		"rustle_group_delivered_total", "Total number of messages delivered to the group.", []string{"group", "stream"}, nil)
+	groupAckedDesc = prometheus.NewDesc(
+		"rustle_group_acked_total", "Total number of messages acked by the group.", []string{"group", "stream"}, nil)
+	groupNackedDesc = prometheus.NewDesc(
+		"rustle_group_nacked_total", "Total number of messages whose delivery has been rejected.", []string{"group", "stream"}, nil)
+	groupRedeliveredDesc = prometheus.NewDesc(
+		"rustle_group_redelivered_total", "Total number of messages delivered again to the group.", []string{"group", "stream"}, nil)
+	groupLagDesc = prometheus.NewDesc(
+		"rustle_group_lag", "Number of messages of the stream not yet delivered to the group.", []string{"group", "stream"}, nil)
+	groupPendingDesc = prometheus.NewDesc(
+		"rustle_group_pending", "Number of messages delivered to the group and not acked yet.", []string{"group", "stream"}, nil)
+
+	groupConsumersDesc = prometheus.NewDesc(
+		"rustle_group_consumers", "Number of consumers connected to the group.", []string{"group"}, nil)
+	consumerBufferedDesc = prometheus.NewDesc(
+		"rustle_consumer_buffered_messages", "Number of messages waiting to be sent to the consumer.", []string{"group", "consumer"}, nil)
+
+	memoryLimitDesc = prometheus.NewDesc(
+		"rustle_memory_limit_bytes", "Size of the memory budget shared by all the namespaces.", nil, nil)
+	memoryUsedDesc = prometheus.NewDesc(
+		"rustle_memory_used_bytes", "Approximate size of the messages stored inside all the namespaces.", nil, nil)
+	memoryEvictedDesc = prometheus.NewDesc(
+		"rustle_memory_evicted_messages_total", "Total number of acked messages evicted to reclaim memory.", nil, nil)
+	memoryRejectedDesc = prometheus.NewDesc(
+		"rustle_memory_rejected_total", "Total number of publishes rejected because the memory budget was exhausted.", nil, nil)
+)
+
+// brokerCollector exports the state of the brokers of all the namespaces, which is collected at scrape time.
+// Streams and groups are labelled with their qualified names, so that names of different namespaces don't collide.
+type brokerCollector struct {
+	n *namespaces
+}
+
+func (c *brokerCollector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(c, ch)
+}
+
+func (c *brokerCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, ctrl := range c.n.list() {
+		collectBroker(ctrl, ch)
+	}
+
+	if m := c.n.opts.Memory; m != nil {
+		usage := m.Usage()
+		ch <- prometheus.MustNewConstMetric(memoryLimitDesc, prometheus.GaugeValue, float64(usage.Limit))
+		ch <- prometheus.MustNewConstMetric(memoryUsedDesc, prometheus.GaugeValue, float64(usage.Used))
+		ch <- prometheus.MustNewConstMetric(memoryEvictedDesc, prometheus.CounterValue, float64(usage.Evicted))
+		ch <- prometheus.MustNewConstMetric(memoryRejectedDesc, prometheus.CounterValue, float64(usage.Rejected))
+	}
+}
+
+func collectBroker(c *controller, ch chan<- prometheus.Metric) {
+	for _, s := range c.b.ListStreams() {
+		s.Name = c.qualify(s.Name)
+
+		ch <- prometheus.MustNewConstMetric(streamPublishedDesc, prometheus.CounterValue, float64(s.Published), s.Name)
+		ch <- prometheus.MustNewConstMetric(streamLengthDesc, prometheus.GaugeValue, float64(s.Length), s.Name)
+		ch <- prometheus.MustNewConstMetric(streamBytesDesc, prometheus.GaugeValue, float64(s.Bytes), s.Name)
+	}
+
+	for _, group := range c.b.ListGroups() {
+		group.Name = c.qualify(group.Name)
+		for _, s := range group.Streams {
+			s.Stream = c.qualify(s.Stream)
+
+			ch <- prometheus.MustNewConstMetric(groupDeliveredDesc, prometheus.CounterValue, float64(s.Delivered), group.Name, s.Stream)
+			ch <- prometheus.MustNewConstMetric(groupAckedDesc, prometheus.CounterValue, float64(s.Acked), group.Name, s.Stream)
+			ch <- prometheus.MustNewConstMetric(groupNackedDesc, prometheus.CounterValue, float64(s.Nacked), group.Name, s.Stream)
+			ch <- prometheus.MustNewConstMetric(groupRedeliveredDesc, prometheus.CounterValue, float64(s.Redelivered), group.Name, s.Stream)
+			ch <- prometheus.MustNewConstMetric(groupLagDesc, prometheus.GaugeValue, float64(s.Lag), group.Name, s.Stream)
+			ch <- prometheus.MustNewConstMetric(groupPendingDesc, prometheus.GaugeValue, float64(s.Pending), group.Name, s.Stream)
+		}
+
+		ch <- prometheus.MustNewConstMetric(groupConsumersDesc, prometheus.GaugeValue, float64(len(group.Consumers)), group.Name)
+		for _, consumer := range group.Consumers {
+			ch <- prometheus.MustNewConstMetric(consumerBufferedDesc, prometheus.GaugeValue, float64(consumer.Buffered), group.Name, consumer.Name)
+		}
+	}
+}
+
+// routeTemplate returns the path template of the route matched by the request (e.g. "/streams/{name}").
+func routeTemplate(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if tpl, err := current.GetPathTemplate(); err == nil {
+			return tpl
+		}
+	}
+	return ""
+}
+
+// statusRecorder captures the status code of a response, while still allowing handlers to flush it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(data)
+}
+
+func (r *statusRecorder) Flush() {
+	r.ResponseWriter.(http.Flusher).Flush()
+}
+
+type metrics struct {
+	registry        *prometheus.Registry
+	requestDuration *prometheus.HistogramVec
+}
+
+func newMetrics(n *namespaces) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "rustle_http_request_duration_seconds",
+			Help:    "Latency of http requests, by route. For subscriptions, this is the lifetime of the connection.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method", "code"}),
+	}
+
+	m.registry.MustRegister(
+		&brokerCollector{n: n},
+		n.limiter.throttled,
+		m.requestDuration,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// instrument is a middleware observing the latency of each request, labelled with the template of the matched route.
+func (m *metrics) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		m.requestDuration.WithLabelValues(routeTemplate(r), r.Method, strconv.Itoa(rec.status)).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/ostafen/rustle/core"
+)
+
+// DefaultNamespace is the namespace of the streams and groups addressed without the /ns/{namespace} prefix.
+const DefaultNamespace = "default"
+
+var (
+	ErrInvalidNamespace = errors.New("invalid namespace")
+	ErrNamespaceExists  = errors.New("namespace already exists")
+)
+
+var namespacePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// namespaces holds the namespaces of the server. Each namespace has a broker of its own,
+// so that streams and groups having the same name in different namespaces are isolated.
+type namespaces struct {
+	mu sync.RWMutex
+	// opts are the options of the brokers of new namespaces, except for quotas
+	opts        core.BrokerOptions
+	acl         *core.ACL
+	limiter     *rateLimiter
+	controllers map[string]*controller
+}
+
+// ValidateNamespace checks whether name can be used as the name of a namespace.
+func ValidateNamespace(name string) error {
+	if !namespacePattern.MatchString(name) {
+		return ErrInvalidNamespace
+	}
+	return nil
+}
+
+func newNamespaces(opts core.BrokerOptions, acl *core.ACL, limiter *rateLimiter) *namespaces {
+	n := &namespaces{
+		opts:        opts,
+		acl:         acl,
+		limiter:     limiter,
+		controllers: make(map[string]*controller),
+	}
+	n.controllers[DefaultNamespace] = newController(DefaultNamespace, &opts, acl, limiter)
+	return n
+}
+
+func (n *namespaces) get(name string) (*controller, bool) {
+	if name == "" {
+		name = DefaultNamespace
+	}
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	c, ok := n.controllers[name]
+	return c, ok
+}
+
+func (n *namespaces) create(name string, quotas core.Quotas) error {
+	if err := ValidateNamespace(name); err != nil {
+		return err
+	}
+
+	opts := n.opts
+	opts.Quotas = quotas
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.controllers[name]; ok {
+		return ErrNamespaceExists
+	}
+	n.controllers[name] = newController(name, &opts, n.acl, n.limiter)
+	return nil
+}
+
+// delete removes a namespace, disconnecting its consumers. The default namespace can't be deleted.
+func (n *namespaces) delete(ctx context.Context, name string) error {
+	if name == DefaultNamespace {
+		return ErrInvalidNamespace
+	}
+
+	n.mu.Lock()
+	c, ok := n.controllers[name]
+	delete(n.controllers, name)
+	n.mu.Unlock()
+
+	if !ok {
+		return errors.New("no such namespace with name " + name)
+	}
+
+	// consumers which are not drained before ctx expires are stopped anyway
+	c.b.Shutdown(ctx)
+
+	// streams are deleted, so that their messages no longer count against the memory budget
+	for _, stream := range c.b.ListStreams() {
+		c.b.DeleteStream(stream.Name)
+		c.limiter.forget(c.qualify(stream.Name))
+	}
+	return nil
+}
+
+// list returns the controllers of all the namespaces, ordered by name.
+func (n *namespaces) list() []*controller {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	controllers := make([]*controller, 0, len(n.controllers))
+	for _, c := range n.controllers {
+		controllers = append(controllers, c)
+	}
+	sort.Slice(controllers, func(i, j int) bool {
+		return controllers[i].namespace < controllers[j].namespace
+	})
+	return controllers
+}
+
+// route adapts a controller handler, so that it is served by the controller of the namespace of the request.
+func (n *namespaces) route(handler func(*controller, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, ok := n.get(mux.Vars(r)["namespace"])
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		handler(c, w, r)
+	}
+}
+
+func (c *controller) namespaceInfo() *core.NamespaceInfo {
+	return &core.NamespaceInfo{
+		Name:   c.namespace,
+		Quotas: c.b.Quotas(),
+		Stats:  c.b.Stats(),
+	}
+}
+
+func (n *namespaces) handleListNamespaces(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	infos := make([]*core.NamespaceInfo, 0)
+	for _, c := range n.list() {
+		if visible(n.acl, r, core.NamespaceResource(c.namespace)) {
+			infos = append(infos, c.namespaceInfo())
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJsonBody(w, infos)
+}
+
+func (n *namespaces) handleNamespace(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["namespace"]
+
+	switch r.Method {
+	case "PUT":
+		if !authorize(n.acl, w, r, core.PermAdmin, core.BrokerResource) {
+			return
+		}
+
+		quotas := core.Quotas{}
+		if err := json.NewDecoder(r.Body).Decode(&quotas); err != nil && err != io.EOF {
+			w.WriteHeader(http.StatusBadRequest)
+		} else if err := n.create(name, quotas); errors.Is(err, ErrNamespaceExists) {
+			w.WriteHeader(http.StatusConflict)
+		} else if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+	case "GET":
+		c, ok := n.get(name)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if !visible(n.acl, r, core.NamespaceResource(name)) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		writeJsonBody(w, c.namespaceInfo())
+	case "DELETE":
+		if !authorize(n.acl, w, r, core.PermAdmin, core.BrokerResource) {
+			return
+		}
+
+		if err := n.delete(r.Context(), name); errors.Is(err, ErrInvalidNamespace) {
+			w.WriteHeader(http.StatusBadRequest)
+		} else if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ostafen/rustle/core"
+)
+
+const (
+	envelopeContentType = "application/vnd.rustle.envelope+json"
+	keyHeader           = "Rustle-Key"
+	headerPrefix        = "Rustle-Header-"
+	delayHeader         = "Rustle-Delay"
+	deliverAtHeader     = "Rustle-Deliver-At"
+	ttlHeader           = "Rustle-TTL"
+	idempotencyHeader   = "Idempotency-Key"
+	replyToHeader       = "Rustle-Reply-To"
+	correlationIdHeader = "Rustle-Correlation-Id"
+)
+
+var (
+	errInvalidTTL       = errors.New("invalid ttl")
+	errInvalidDeliverAt = errors.New("invalid delivery instant")
+)
+
+// envelope is the body of a publish request sent with the envelope content type,
+// allowing to supply message metadata along with data.
+type envelope struct {
+	Key            string            `json:"key"`
+	Headers        map[string]string `json:"headers"`
+	IdempotencyKey string            `json:"idempotencyKey"`
+	ReplyTo        string            `json:"replyTo"`
+	CorrelationId  string            `json:"correlationId"`
+	// Delay (e.g. "15m") or DeliverAt can be used to postpone delivery of the message
+	Delay     string     `json:"delay"`
+	DeliverAt *time.Time `json:"deliverAt"`
+	// TTL (e.g. "30s") or ExpiresAt can be used to discard the message if not delivered in time
+	TTL       string      `json:"ttl"`
+	ExpiresAt *time.Time  `json:"expiresAt"`
+	Data      interface{} `json:"data"`
+}
+
+func (env *envelope) toMessage(stream string) (*core.Message, error) {
+	msg := core.NewMessage(stream, env.Data)
+	msg.Key = env.Key
+	msg.IdempotencyKey = env.IdempotencyKey
+	msg.ReplyTo = env.ReplyTo
+	msg.CorrelationId = env.CorrelationId
+
+	for name, value := range env.Headers {
+		setHeader(msg, name, value)
+	}
+
+	var deliverAt *time.Time
+	if env.Delay != "" {
+		delay, err := time.ParseDuration(env.Delay)
+		if err != nil {
+			return nil, err
+		}
+		t := time.Unix(0, int64(msg.Timestamp)).Add(delay)
+		deliverAt = &t
+	} else if env.DeliverAt != nil {
+		deliverAt = env.DeliverAt
+	}
+
+	if deliverAt != nil {
+		// instants which can't be represented as unsigned unix nanoseconds would wrap around
+		if deliverAt.Before(time.Unix(0, 0)) || deliverAt.After(time.Unix(0, math.MaxInt64)) {
+			return nil, errInvalidDeliverAt
+		}
+		msg.DeliverAt = uint64(deliverAt.UnixNano())
+	}
+
+	// the time to live of a delayed message starts when it becomes visible
+	if env.TTL != "" {
+		ttl, err := time.ParseDuration(env.TTL)
+		if err != nil || ttl <= 0 {
+			return nil, errInvalidTTL
+		}
+
+		visibleAt := msg.Timestamp
+		if msg.DeliverAt > visibleAt {
+			visibleAt = msg.DeliverAt
+		}
+		msg.ExpiresAt = visibleAt + uint64(ttl)
+	} else if env.ExpiresAt != nil {
+		msg.ExpiresAt = uint64(env.ExpiresAt.UnixNano())
+	}
+	return msg, nil
+}
+
+func setHeader(msg *core.Message, name string, value string) {
+	if msg.Headers == nil {
+		msg.Headers = make(map[string]string)
+	}
+	msg.Headers[strings.ToLower(name)] = value
+}
+
+type publishResponse struct {
+	Id string `json:"id"`
+	// Partition and Offset are omitted for delayed messages, which are reported as scheduled instead,
+	// since they are assigned a position only once they are due.
+	Partition *int    `json:"partition,omitempty"`
+	Offset    *uint64 `json:"offset,omitempty"`
+	Scheduled bool    `json:"scheduled,omitempty"`
+	// Duplicate reports whether the message has been discarded since it has the same
+	// idempotency key of a recently published message, whose id is returned.
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
+func newPublishResponse(msg *core.Message, duplicate bool) *publishResponse {
+	res := &publishResponse{
+		Id:        msg.Id,
+		Duplicate: duplicate,
+	}
+
+	if msg.Delayed() {
+		res.Scheduled = true
+	} else {
+		partition, offset := msg.Partition, msg.Offset
+		res.Partition, res.Offset = &partition, &offset
+	}
+	return res
+}
+
+// decodeMessage builds a message from a publish request. Unless the envelope content type is used,
+// the whole body is taken as message data, while metadata is read from the Rustle-* http headers.
+// When both are supplied, http headers take precedence over envelope fields.
+func decodeMessage(r *http.Request, stream string) (*core.Message, error) {
+	env := &envelope{}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == envelopeContentType {
+		if err := json.NewDecoder(r.Body).Decode(env); err != nil {
+			return nil, err
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&env.Data); err != nil {
+		return nil, err
+	}
+
+	if key := r.Header.Get(keyHeader); key != "" {
+		env.Key = key
+	}
+	if key := r.Header.Get(idempotencyHeader); key != "" {
+		env.IdempotencyKey = key
+	}
+	if replyTo := r.Header.Get(replyToHeader); replyTo != "" {
+		env.ReplyTo = replyTo
+	}
+	if correlationId := r.Header.Get(correlationIdHeader); correlationId != "" {
+		env.CorrelationId = correlationId
+	}
+	if delay := r.Header.Get(delayHeader); delay != "" {
+		env.Delay = delay
+	}
+	if deliverAt := r.Header.Get(deliverAtHeader); deliverAt != "" {
+		t, err := time.Parse(time.RFC3339, deliverAt)
+		if err != nil {
+			return nil, err
+		}
+		env.DeliverAt = &t
+	}
+	if ttl := r.Header.Get(ttlHeader); ttl != "" {
+		env.TTL = ttl
+	}
+
+	msg, err := env.toMessage(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, values := range r.Header {
+		if strings.HasPrefix(name, headerPrefix) && len(values) > 0 {
+			setHeader(msg, strings.TrimPrefix(name, headerPrefix), values[0])
+		}
+	}
+
+	core.InjectContext(r.Context(), msg)
+	return msg, nil
+}
+
+// txEntry is a message of a transaction, which also specifies its target stream.
+type txEntry struct {
+	Stream string `json:"stream"`
+	envelope
+}
+
+// handleTx publishes messages to several streams atomically: either all of them are appended or none.
+func (c *controller) handleTx(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !c.limiter.limitBody(w, r) {
+		return
+	}
+
+	entries := make([]*txEntry, 0)
+	if err := json.NewDecoder(r.Body).Decode(&entries); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	msgs := make([]*core.Message, 0, len(entries))
+	for _, entry := range entries {
+		msg, err := entry.toMessage(entry.Stream)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if !c.authorize(w, r, core.PermPublish, c.streamResource(entry.Stream)) {
+			return
+		}
+		core.InjectContext(r.Context(), msg)
+		msgs = append(msgs, msg)
+	}
+
+	reservations, ok := c.throttle(w, r, msgs)
+	if !ok {
+		return
+	}
+
+	published, duplicates, err := c.b.NotifyMessages(msgs)
+	if err != nil {
+		c.limiter.refund(reservations)
+		writeError(w, err)
+		return
+	}
+
+	res := make([]*publishResponse, 0, len(published))
+	for i, msg := range published {
+		res = append(res, newPublishResponse(msg, duplicates[i]))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJsonBody(w, res)
+}
@@ -0,0 +1,245 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ostafen/rustle/core"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var ErrInvalidRateLimits = errors.New("invalid rate limits")
+
+// RateLimits bounds the load which producers can put on the server. Zero values disable the corresponding limit.
+type RateLimits struct {
+	// GlobalRate, PrincipalRate and StreamRate are the maximum number of messages per second which can be
+	// published to the whole server, by each principal and to each stream. Bursts of up to one second worth
+	// of messages are allowed. Publishes exceeding them are rejected with 429 Too Many Requests.
+	GlobalRate    float64
+	PrincipalRate float64
+	StreamRate    float64
+	// MaxMessageSize is the maximum size of a message (see core.Message.Size)
+	MaxMessageSize int
+	// MaxRequestBody is the maximum size of the body of publish requests, including transactions
+	MaxRequestBody int64
+}
+
+func (l *RateLimits) Validate() error {
+	if l.GlobalRate < 0 || l.PrincipalRate < 0 || l.StreamRate < 0 || l.MaxMessageSize < 0 || l.MaxRequestBody < 0 {
+		return ErrInvalidRateLimits
+	}
+	return nil
+}
+
+// minPruneBuckets is the number of buckets of a limit below which they are never pruned.
+const minPruneBuckets = 1024
+
+// bucketSet holds the token buckets of a limit by key. Full buckets are equivalent to new ones, so they are
+// pruned once the number of buckets doubles, which never resets a bucket still limiting its key.
+type bucketSet struct {
+	rate  float64
+	items map[string]*core.TokenBucket
+	// pruneAt is the number of buckets at which full buckets are pruned
+	pruneAt int
+}
+
+func newBucketSet(rate float64) *bucketSet {
+	return &bucketSet{
+		rate:    rate,
+		items:   make(map[string]*core.TokenBucket),
+		pruneAt: minPruneBuckets,
+	}
+}
+
+// get returns the bucket associated to key, creating it if missing.
+func (bs *bucketSet) get(key string, now int64) *core.TokenBucket {
+	if tb, ok := bs.items[key]; ok {
+		return tb
+	}
+
+	if len(bs.items) >= bs.pruneAt {
+		bs.prune(now)
+	}
+
+	tb := core.NewTokenBucket(bs.rate, math.Max(bs.rate, 1), now)
+	bs.items[key] = tb
+	return tb
+}
+
+func (bs *bucketSet) prune(now int64) {
+	for key, tb := range bs.items {
+		if tb.Full(now) {
+			delete(bs.items, key)
+		}
+	}
+
+	bs.pruneAt = 2 * len(bs.items)
+	if bs.pruneAt < minPruneBuckets {
+		bs.pruneAt = minPruneBuckets
+	}
+}
+
+// rateLimiter enforces the rate limits of publishes, which are shared by all the namespaces.
+type rateLimiter struct {
+	limits RateLimits
+
+	mu         sync.Mutex
+	global     *core.TokenBucket
+	principals *bucketSet
+	// streams holds the buckets of existing streams, which are discarded when streams are deleted
+	streams *bucketSet
+
+	// throttled counts the rejected publish requests, by exceeded limit
+	throttled *prometheus.CounterVec
+}
+
+func newRateLimiter(limits RateLimits) *rateLimiter {
+	l := &rateLimiter{
+		limits:     limits,
+		principals: newBucketSet(limits.PrincipalRate),
+		streams:    newBucketSet(limits.StreamRate),
+		throttled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rustle_throttled_requests_total",
+			Help: "Total number of publish requests rejected because of rate limits, by exceeded limit.",
+		}, []string{"limit"}),
+	}
+
+	if limits.GlobalRate > 0 {
+		l.global = core.NewTokenBucket(limits.GlobalRate, math.Max(limits.GlobalRate, 1), time.Now().UnixNano())
+	}
+	return l
+}
+
+type reservation struct {
+	limit string
+	tb    *core.TokenBucket
+	n     float64
+}
+
+// allow reserves the tokens for publishing a message to each of the given streams on behalf of principal,
+// returning the reservations, which are refunded if the publish fails. If some limit is exceeded,
+// no token is consumed, and the limit is returned along with the time to wait.
+func (l *rateLimiter) allow(principal string, streams []string) ([]reservation, string, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now().UnixNano()
+
+	reservations := make([]reservation, 0, len(streams)+2)
+	if l.global != nil {
+		reservations = append(reservations, reservation{"global", l.global, float64(len(streams))})
+	}
+	if l.limits.PrincipalRate > 0 {
+		reservations = append(reservations, reservation{"principal", l.principals.get(principal, now), float64(len(streams))})
+	}
+	if l.limits.StreamRate > 0 {
+		counts := make(map[string]int)
+		for _, stream := range streams {
+			counts[stream]++
+		}
+
+		for stream, n := range counts {
+			reservations = append(reservations, reservation{"stream", l.streams.get(stream, now), float64(n)})
+		}
+	}
+
+	var limit string
+	var wait time.Duration
+	for _, res := range reservations {
+		if w := res.tb.Wait(now, res.n); w > wait {
+			limit, wait = res.limit, w
+		}
+	}
+
+	if wait > 0 {
+		return nil, limit, wait
+	}
+
+	for _, res := range reservations {
+		res.tb.Take(now, res.n)
+	}
+	return reservations, "", 0
+}
+
+// refund gives back the tokens of publishes which have been rejected by the broker.
+func (l *rateLimiter) refund(reservations []reservation) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, res := range reservations {
+		res.tb.Refund(res.n)
+	}
+}
+
+// forget discards the bucket of a deleted stream.
+func (l *rateLimiter) forget(stream string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.streams.items, stream)
+}
+
+// setRetryAfter sets the Retry-After header of a response, rounding the delay up to seconds.
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
+
+// limitBody reads the body of a publish request, responding with 413 if it exceeds MaxRequestBody.
+func (l *rateLimiter) limitBody(w http.ResponseWriter, r *http.Request) bool {
+	max := l.limits.MaxRequestBody
+	if max <= 0 {
+		return true
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, max+1))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return false
+	}
+
+	if int64(len(data)) > max {
+		l.throttled.WithLabelValues("request_body").Inc()
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	return true
+}
+
+// throttle checks the size of messages and the rate limits before they are published, responding with 413
+// if some message is too large, or with 429 if some rate limit is exceeded. Publishes to missing streams are
+// rejected with 404 beforehand, so that buckets are only created for existing streams.
+// It returns the reservations of the tokens taken, which must be refunded if the broker rejects the publish.
+func (c *controller) throttle(w http.ResponseWriter, r *http.Request, msgs []*core.Message) ([]reservation, bool) {
+	l := c.limiter
+
+	streams := make([]string, 0, len(msgs))
+	for _, msg := range msgs {
+		if l.limits.StreamRate > 0 && !c.b.HasStream(msg.Stream) {
+			w.WriteHeader(http.StatusNotFound)
+			return nil, false
+		}
+
+		if max := l.limits.MaxMessageSize; max > 0 && msg.Size() > max {
+			l.throttled.WithLabelValues("message_size").Inc()
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+		streams = append(streams, c.qualify(msg.Stream))
+	}
+
+	reservations, limit, wait := l.allow(principal(r), streams)
+	if wait > 0 {
+		l.throttled.WithLabelValues(limit).Inc()
+		setRetryAfter(w, wait)
+		w.WriteHeader(http.StatusTooManyRequests)
+		return nil, false
+	}
+	return reservations, true
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSOptions configures the server to serve https.
+type TLSOptions struct {
+	// CertFile and KeyFile are the paths of the PEM encoded certificate and private key of the server.
+	// They are reloaded whenever they change on disk, so that certificates can be renewed without restarting.
+	CertFile string
+	KeyFile  string
+	// ClientCAFile, if set, is the path of a PEM bundle of the CAs used to verify client certificates.
+	// Clients presenting a certificate which is not signed by one of them are rejected.
+	ClientCAFile string
+	// RequireClientCert makes clients without a certificate be rejected as well
+	RequireClientCert bool
+}
+
+// certReloader loads a certificate, reloading it on handshakes after its files have been modified.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.getCertificate(nil); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// lastModified returns the latest modification time of the certificate and key files.
+func (r *certReloader) lastModified() (time.Time, error) {
+	var last time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return last, err
+		}
+
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last, nil
+}
+
+// getCertificate returns the current certificate. If the files can't be loaded (for example, because
+// they are being replaced), the previous certificate is kept, and loading is attempted again on the next handshake.
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTime, err := r.lastModified()
+	if err == nil && (r.cert == nil || !modTime.Equal(r.modTime)) {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(r.certFile, r.keyFile); err == nil {
+			r.cert = &cert
+			r.modTime = modTime
+		}
+	}
+
+	if r.cert == nil {
+		return nil, fmt.Errorf("unable to load certificate: %w", err)
+	}
+	return r.cert, nil
+}
+
+func newTLSConfig(opts *TLSOptions) (*tls.Config, error) {
+	reloader, err := newCertReloader(opts.CertFile, opts.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.getCertificate,
+	}
+
+	if opts.ClientCAFile != "" {
+		data, err := os.ReadFile(opts.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read client CAs: %w", err)
+		}
+
+		conf.ClientCAs = x509.NewCertPool()
+		if !conf.ClientCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found inside %s", opts.ClientCAFile)
+		}
+
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+		if opts.RequireClientCert {
+			conf.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if opts.RequireClientCert {
+		return nil, errors.New("client certificates can't be required without a client CA")
+	}
+	return conf, nil
+}
+
+// ClientCertificates authenticates requests through the verified certificate presented by the client
+// (see TLSOptions.ClientCAFile). The principal is the common name of the certificate subject.
+type ClientCertificates struct{}
+
+func (ClientCertificates) Authenticate(r *http.Request) (*Identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil, ErrNoCredentials
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	if cert.Subject.CommonName == "" {
+		return nil, ErrInvalidCredentials
+	}
+	return &Identity{Principal: cert.Subject.CommonName, Method: "mtls"}, nil
+}